@@ -0,0 +1,238 @@
+package arbor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// An archive holds the contents of a Store in a form that can be saved or
+// moved between servers. Archives are written by Store.Export and read by
+// Store.Import.
+//
+// An archive is a sequence of JSON objects, one per line. The first line is
+// a header:
+//
+//	{"Format":"arbor-archive","Version":1,"Root":"<root id>","Major":0,"Minor":1}
+//
+// Major and Minor are the protocol version of the software that wrote the
+// archive. Archives with a Major other than ProtocolMajor cannot be imported.
+// The header is followed by one line per message:
+//
+//	{"Message":{"UUID":"...","Parent":"...","Content":"...","Username":"...","Timestamp":0}}
+//
+// A message line may also hold "Deleted":true if the message has been
+// deleted (see Store.Apply), in which case the message is its tombstone, or
+// "History":[...] holding the previous versions of an edited message.
+// Messages are in topological order: no message appears after one of its
+// replies. The final line is a trailer that allows the archive's integrity
+// to be verified:
+//
+//	{"Trailer":{"Count":2,"SHA256":"<hex digest>"}}
+//
+// Count is the number of message lines, and SHA256 is the digest of the
+// message lines exactly as they appear in the archive, newlines included.
+const (
+	// ArchiveFormat is the value of the Format field in an archive's header
+	ArchiveFormat = "arbor-archive"
+	// ArchiveVersion is the version of the archive format written by Export
+	ArchiveVersion = 1
+)
+
+// archiveHeader is the first line of an archive.
+type archiveHeader struct {
+	Format  string
+	Version int
+	Root    string
+	Major   uint8
+	Minor   uint8
+}
+
+// archiveTrailer summarizes the messages in an archive.
+type archiveTrailer struct {
+	Count  int
+	SHA256 string
+}
+
+// archiveEntry is any line of an archive after the header.
+type archiveEntry struct {
+	Message *ChatMessage    `json:",omitempty"`
+	Deleted bool            `json:",omitempty"`
+	History []*ChatMessage  `json:",omitempty"`
+	Trailer *archiveTrailer `json:",omitempty"`
+}
+
+// Export writes the store's root and every message that it holds to w as an
+// archive, along with which messages have been deleted and the previous
+// versions of edited messages. Messages are ordered so that every message
+// appears before its replies.
+func (s *Store) Export(w io.Writer) error {
+	var root string
+	var ordered []archiveEntry
+	var cyclic bool
+	if err := s.doContext(context.Background(), func() {
+		root = s.root
+		var msgs []*ChatMessage
+		msgs, cyclic = s.topological()
+		for _, msg := range msgs {
+			_, deleted := s.deleted[msg.UUID]
+			history := append([]*ChatMessage(nil), s.history[msg.UUID]...)
+			ordered = append(ordered, archiveEntry{Message: msg, Deleted: deleted, History: history})
+		}
+	}); err != nil {
+		return err
+	}
+	if cyclic {
+		return errors.New("Cannot export store whose messages form a cycle")
+	}
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	if err := encoder.Encode(archiveHeader{
+		Format:  ArchiveFormat,
+		Version: ArchiveVersion,
+		Root:    root,
+		Major:   ProtocolMajor,
+		Minor:   ProtocolMinor,
+	}); err != nil {
+		return errors.Wrapf(err, "Unable to write archive header")
+	}
+	digest := sha256.New()
+	for _, entry := range ordered {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to encode message %s", entry.Message.UUID)
+		}
+		line = append(line, '\n')
+		_, _ = digest.Write(line)
+		if _, err := buffered.Write(line); err != nil {
+			return errors.Wrapf(err, "Unable to write message %s", entry.Message.UUID)
+		}
+	}
+	if err := encoder.Encode(archiveEntry{Trailer: &archiveTrailer{
+		Count:  len(ordered),
+		SHA256: hex.EncodeToString(digest.Sum(nil)),
+	}}); err != nil {
+		return errors.Wrapf(err, "Unable to write archive trailer")
+	}
+	return buffered.Flush()
+}
+
+// topological returns every message in the store ordered so that parents
+// precede their replies, along with whether any messages had to be left out
+// because they form a cycle. It must only be called from the dispatch
+// goroutine.
+func (s *Store) topological() ([]*ChatMessage, bool) {
+	ordered := make([]*ChatMessage, 0, len(s.m))
+	var level []string
+	for id, msg := range s.m {
+		if _, ok := s.m[msg.Parent]; !ok || msg.Parent == id {
+			level = append(level, id)
+		}
+	}
+	visited := map[string]struct{}{}
+	for len(level) > 0 {
+		var next []string
+		for _, id := range level {
+			if _, seen := visited[id]; seen {
+				continue
+			}
+			visited[id] = struct{}{}
+			ordered = append(ordered, s.m[id])
+			next = append(next, s.children[id]...)
+		}
+		level = next
+	}
+	return ordered, len(ordered) != len(s.m)
+}
+
+// Import reads an archive written by Export from r and adds its messages to
+// the store, restoring their deletions and edit history. The entire archive is verified before any messages are added, so
+// a corrupt archive leaves the store unchanged. If the store has no root, it
+// adopts the root recorded in the archive.
+func (s *Store) Import(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read archive header")
+	}
+	header := archiveHeader{}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return errors.Wrapf(err, "Unable to decode archive header")
+	}
+	if header.Format != ArchiveFormat {
+		return errors.Errorf("Not an archive, format is %q", header.Format)
+	}
+	if header.Version != ArchiveVersion {
+		return errors.Errorf("Unsupported archive version %d", header.Version)
+	}
+	if header.Major != ProtocolMajor {
+		return errors.Errorf("Archive written for incompatible protocol version %v", Version{Major: header.Major, Minor: header.Minor})
+	}
+	digest := sha256.New()
+	var entries []archiveEntry
+	seen := map[string]struct{}{}
+	referenced := map[string]struct{}{}
+	for {
+		line, err = reader.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+			return errors.New("Archive is truncated, no trailer found")
+		} else if err != nil && err != io.EOF {
+			return errors.Wrapf(err, "Unable to read archive")
+		}
+		entry := archiveEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return errors.Wrapf(err, "Unable to decode archive entry %d", len(entries)+1)
+		}
+		if entry.Trailer != nil {
+			if err := verifyTrailer(entry.Trailer, len(entries), digest.Sum(nil)); err != nil {
+				return err
+			}
+			break
+		}
+		msg := entry.Message
+		if msg == nil || msg.UUID == "" {
+			return errors.Errorf("Archive entry %d is not a message", len(entries)+1)
+		}
+		if _, ok := seen[msg.UUID]; ok {
+			return errors.Errorf("Message %s appears more than once in archive", msg.UUID)
+		}
+		if _, ok := referenced[msg.UUID]; ok {
+			return errors.Errorf("Message %s appears after its replies in archive", msg.UUID)
+		}
+		seen[msg.UUID] = struct{}{}
+		referenced[msg.Parent] = struct{}{}
+		_, _ = digest.Write(line)
+		entries = append(entries, entry)
+	}
+	return s.doContext(context.Background(), func() {
+		if s.root == "" {
+			s.root = header.Root
+		}
+		for _, entry := range entries {
+			if entry.Deleted {
+				s.deleted[entry.Message.UUID] = struct{}{}
+			}
+			s.insert(entry.Message)
+			if _, kept := s.m[entry.Message.UUID]; kept && len(entry.History) > 0 {
+				s.history[entry.Message.UUID] = entry.History
+			}
+		}
+	})
+}
+
+// verifyTrailer checks that the archive trailer matches the messages read.
+func verifyTrailer(trailer *archiveTrailer, count int, digest []byte) error {
+	if trailer.Count != count {
+		return errors.Errorf("Archive trailer expects %d messages, found %d", trailer.Count, count)
+	}
+	if trailer.SHA256 != hex.EncodeToString(digest) {
+		return errors.New("Archive checksum does not match its contents")
+	}
+	return nil
+}
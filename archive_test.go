@@ -0,0 +1,128 @@
+package arbor_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// TestExportImport ensures that a store's contents survive a round trip through an
+// archive and that parents precede their replies in the archive.
+func TestExportImport(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	source := arbor.NewStore()
+	defer source.Close()
+	source.SetRoot("root")
+	tree := buildTree(source)
+	// a reply whose parent was never received is still exported
+	source.Add(&arbor.ChatMessage{UUID: "orphan", Parent: nonexsitentID})
+
+	archive := new(bytes.Buffer)
+	g.Expect(source.Export(archive)).To(gomega.Succeed())
+
+	position := map[string]int{}
+	for i, line := range strings.Split(strings.TrimSpace(archive.String()), "\n") {
+		entry := struct{ Message *arbor.ChatMessage }{}
+		g.Expect(json.Unmarshal([]byte(line), &entry)).To(gomega.Succeed())
+		if entry.Message != nil {
+			position[entry.Message.UUID] = i
+		}
+	}
+	for id, msg := range tree {
+		if msg.Parent != "" {
+			g.Expect(position[msg.Parent]).To(gomega.BeNumerically("<", position[id]))
+		}
+	}
+
+	destination := arbor.NewStore()
+	defer destination.Close()
+	g.Expect(destination.Import(archive)).To(gomega.Succeed())
+	g.Expect(destination.Root()).To(gomega.Equal("root"))
+	for id, msg := range tree {
+		g.Expect(destination.Get(id).Equals(msg)).To(gomega.BeTrue())
+	}
+	g.Expect(destination.Has("orphan")).To(gomega.BeTrue())
+}
+
+// TestExportImportChanges ensures that deletions and edit history survive a round trip
+// through an archive.
+func TestExportImportChanges(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	source := arbor.NewStore()
+	defer source.Close()
+	tree := buildTree(source)
+	for _, msg := range tree {
+		msg.Username = testUser
+	}
+	g.Expect(source.Apply(arbor.NewEdit("b", testUser, "edited"))).To(gomega.Succeed())
+	g.Expect(source.Apply(arbor.NewDelete("a", testUser))).To(gomega.Succeed())
+
+	archive := new(bytes.Buffer)
+	g.Expect(source.Export(archive)).To(gomega.Succeed())
+	destination := arbor.NewStore()
+	defer destination.Close()
+	g.Expect(destination.Import(archive)).To(gomega.Succeed())
+
+	g.Expect(destination.IsDeleted("a")).To(gomega.BeTrue())
+	g.Expect(destination.Get("a").Content).To(gomega.Equal(arbor.TombstoneContent))
+	g.Expect(destination.Get("b").Content).To(gomega.Equal("edited"))
+	history := destination.History("b")
+	g.Expect(history).To(gomega.HaveLen(1))
+	g.Expect(history[0].Equals(tree["b"])).To(gomega.BeTrue())
+	// the deleted message must not come back
+	destination.Add(tree["a"])
+	g.Expect(destination.Get("a").Content).To(gomega.Equal(arbor.TombstoneContent))
+}
+
+// archiveOf builds an archive containing the given message lines with a valid trailer.
+func archiveOf(lines ...string) string {
+	digest := sha256.New()
+	body := ""
+	for _, line := range lines {
+		body += line + "\n"
+	}
+	_, _ = digest.Write([]byte(body))
+	return fmt.Sprintf("{\"Format\":\"%s\",\"Version\":%d,\"Root\":\"root\",\"Major\":%d,\"Minor\":%d}\n%s{\"Trailer\":{\"Count\":%d,\"SHA256\":\"%s\"}}\n",
+		arbor.ArchiveFormat, arbor.ArchiveVersion, arbor.ProtocolMajor, arbor.ProtocolMinor, body, len(lines), hex.EncodeToString(digest.Sum(nil)))
+}
+
+// TestImportInvalid ensures that damaged or misordered archives are rejected without
+// modifying the store.
+func TestImportInvalid(t *testing.T) {
+	parent := `{"Message":{"UUID":"parent","Content":"parent"}}`
+	child := `{"Message":{"UUID":"child","Parent":"parent","Content":"child"}}`
+	valid := archiveOf(parent, child)
+	for name, archive := range map[string]string{
+		"child before parent": archiveOf(child, parent),
+		"duplicate":           archiveOf(parent, parent),
+		"missing id":          archiveOf(`{"Message":{"Content":"parent"}}`),
+		"tampered":            strings.Replace(valid, `"Content":"child"`, `"Content":"evil"`, 1),
+		"truncated":           valid[:strings.Index(valid, `{"Trailer"`)],
+		"wrong count":         strings.Replace(valid, `"Count":2`, `"Count":3`, 1),
+		"wrong format":        strings.Replace(valid, arbor.ArchiveFormat, "zip", 1),
+		"wrong version":       strings.Replace(valid, `"Version":1`, `"Version":99`, 1),
+		"wrong major":         strings.Replace(valid, fmt.Sprintf(`"Major":%d`, arbor.ProtocolMajor), `"Major":99`, 1),
+		"empty":               "",
+	} {
+		s := arbor.NewStore()
+		if err := s.Import(strings.NewReader(archive)); err == nil {
+			t.Errorf("Expected error importing %s archive", name)
+		}
+		if s.Has("parent") || s.Has("child") {
+			t.Errorf("Importing %s archive modified the store", name)
+		}
+		_ = s.Close()
+	}
+	s := arbor.NewStore()
+	defer s.Close()
+	if err := s.Import(strings.NewReader(valid)); err != nil {
+		t.Error("Unable to import valid archive", err)
+	}
+}
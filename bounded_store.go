@@ -0,0 +1,201 @@
+package arbor
+
+import (
+	"container/heap"
+	"container/list"
+	"time"
+)
+
+// StoreLimits configures the size of a bounded Store. The zero value places
+// no limits on the Store.
+type StoreLimits struct {
+	// MaxMessages is the largest number of messages that the Store will hold.
+	// When it is exceeded, the least recently accessed messages are evicted.
+	// Zero means no limit.
+	MaxMessages int
+	// MaxAge is the age, measured from a message's Timestamp, beyond which a
+	// message is evicted. Zero means no limit.
+	MaxAge time.Duration
+	// PinRecent is the number of most recent leaves (see Leaves) that are
+	// never evicted, so that the active ends of conversations remain available.
+	// The root configured with SetRoot is always pinned.
+	PinRecent int
+	// OnEvict, if non-nil, is called with each message as it is evicted, for
+	// instance so that it can be written elsewhere or queried again later. It
+	// is called from the Store's internal goroutine, so it must not call any
+	// methods on the Store.
+	OnEvict func(*ChatMessage)
+}
+
+// bounded reports whether the limits restrict the Store at all.
+func (l StoreLimits) bounded() bool {
+	return l.MaxMessages > 0 || l.MaxAge > 0
+}
+
+// sweepInterval returns how often the Store checks for expired messages.
+func (l StoreLimits) sweepInterval() time.Duration {
+	interval := l.MaxAge / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// NewBoundedStore creates a Store that evicts messages in order to stay within
+// the provided limits. Messages that have been neither added nor retrieved
+// with Get recently are evicted first.
+func NewBoundedStore(limits StoreLimits) *Store {
+	s := newStore()
+	s.limits = limits
+	if limits.bounded() {
+		s.lru = list.New()
+		s.elements = make(map[string]*list.Element)
+	}
+	go s.dispatch()
+	return s
+}
+
+// touch marks the message with the given id as recently accessed. It must only
+// be called from the dispatch goroutine.
+func (s *Store) touch(id string) {
+	if s.lru == nil {
+		return
+	}
+	if element, ok := s.elements[id]; ok {
+		s.lru.MoveToFront(element)
+	} else if _, ok := s.m[id]; ok {
+		s.elements[id] = s.lru.PushFront(id)
+	}
+}
+
+// forget removes the message with the given id from the access order. It must
+// only be called from the dispatch goroutine.
+func (s *Store) forget(id string) {
+	if s.lru == nil {
+		return
+	}
+	if element, ok := s.elements[id]; ok {
+		s.lru.Remove(element)
+		delete(s.elements, id)
+	}
+}
+
+// pinned returns the set of message ids that may not be evicted. It must only
+// be called from the dispatch goroutine.
+func (s *Store) pinned() map[string]bool {
+	pinned := map[string]bool{s.root: true}
+	if s.limits.PinRecent <= 0 {
+		return pinned
+	}
+	// keep the most recent leaves in a heap whose least recent is on top
+	leaves := &recentLeaves{store: s}
+	for id, msg := range s.m {
+		if len(s.children[id]) > 0 {
+			continue
+		}
+		if leaves.Len() < s.limits.PinRecent {
+			heap.Push(leaves, msg)
+		} else if leaves.newer(msg, leaves.messages[0]) {
+			leaves.messages[0] = msg
+			heap.Fix(leaves, 0)
+		}
+	}
+	for _, msg := range leaves.messages {
+		pinned[msg.UUID] = true
+	}
+	return pinned
+}
+
+// recentLeaves is a heap of leaves ordered from least to most recent.
+type recentLeaves struct {
+	store    *Store
+	messages []*ChatMessage
+}
+
+// newer reports whether a is more recent than b. Messages with the same
+// Timestamp are ordered by when they were added to the store.
+func (h *recentLeaves) newer(a, b *ChatMessage) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp > b.Timestamp
+	}
+	return h.store.added[a.UUID] > h.store.added[b.UUID]
+}
+
+func (h *recentLeaves) Len() int           { return len(h.messages) }
+func (h *recentLeaves) Less(i, j int) bool { return h.newer(h.messages[j], h.messages[i]) }
+func (h *recentLeaves) Swap(i, j int)      { h.messages[i], h.messages[j] = h.messages[j], h.messages[i] }
+func (h *recentLeaves) Push(x interface{}) { h.messages = append(h.messages, x.(*ChatMessage)) }
+func (h *recentLeaves) Pop() interface{} {
+	last := h.messages[len(h.messages)-1]
+	h.messages = h.messages[:len(h.messages)-1]
+	return last
+}
+
+// evict removes the message with the given id and reports it to the eviction
+// callback. It must only be called from the dispatch goroutine.
+func (s *Store) evict(id string) {
+	msg, ok := s.m[id]
+	if !ok {
+		return
+	}
+	s.remove(id)
+	if s.limits.OnEvict != nil {
+		s.limits.OnEvict(msg)
+	}
+}
+
+// expired reports whether the message is older than the maximum age allowed.
+func (s *Store) expired(msg *ChatMessage, now time.Time) bool {
+	return s.limits.MaxAge > 0 && msg.Timestamp < now.Add(-s.limits.MaxAge).Unix()
+}
+
+// overfull reports whether the store holds more messages than allowed. It
+// must only be called from the dispatch goroutine.
+func (s *Store) overfull() bool {
+	return s.limits.MaxMessages > 0 && len(s.m) > s.limits.MaxMessages
+}
+
+// enforceLimits evicts messages until the store is within its limits after
+// msg has been inserted. It must only be called from the dispatch goroutine.
+func (s *Store) enforceLimits(msg *ChatMessage) {
+	expired := s.expired(msg, time.Now())
+	if !expired && !s.overfull() {
+		return
+	}
+	// only leaves can be pinned apart from the root, so finding the most
+	// recent leaves can usually be avoided
+	var pinned map[string]bool
+	isPinned := func(id string) bool {
+		if id == s.root {
+			return true
+		}
+		if s.limits.PinRecent <= 0 || len(s.children[id]) > 0 {
+			return false
+		}
+		if pinned == nil {
+			pinned = s.pinned()
+		}
+		return pinned[id]
+	}
+	if expired && !isPinned(msg.UUID) {
+		s.evict(msg.UUID)
+	}
+	for element := s.lru.Back(); element != nil && s.overfull(); {
+		previous := element.Prev()
+		if id := element.Value.(string); !isPinned(id) {
+			s.evict(id)
+		}
+		element = previous
+	}
+}
+
+// expire evicts every unpinned message older than the maximum age. It must
+// only be called from the dispatch goroutine.
+func (s *Store) expire(now time.Time) {
+	pinned := s.pinned()
+	for id, msg := range s.m {
+		if !pinned[id] && s.expired(msg, now) {
+			s.evict(id)
+		}
+	}
+}
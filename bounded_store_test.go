@@ -0,0 +1,112 @@
+package arbor_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/arbor-go/storetest"
+	"github.com/onsi/gomega"
+)
+
+// TestBoundedStoreConformance runs the shared MessageStore test suite against a
+// bounded Store whose limits are too large to be reached.
+func TestBoundedStoreConformance(t *testing.T) {
+	storetest.Run(t, func(*testing.T) arbor.MessageStore {
+		return arbor.NewBoundedStore(arbor.StoreLimits{MaxMessages: iterations, MaxAge: time.Hour * 24 * 365 * 100})
+	})
+}
+
+// evictionRecorder collects the ids of evicted messages.
+type evictionRecorder struct {
+	sync.Mutex
+	evicted []string
+}
+
+func (r *evictionRecorder) record(m *arbor.ChatMessage) {
+	r.Lock()
+	defer r.Unlock()
+	r.evicted = append(r.evicted, m.UUID)
+}
+
+func (r *evictionRecorder) ids() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.evicted...)
+}
+
+// TestBoundedStoreMaxMessages ensures that the least recently accessed messages are
+// evicted once the store is full.
+func TestBoundedStoreMaxMessages(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	recorder := &evictionRecorder{}
+	s := arbor.NewBoundedStore(arbor.StoreLimits{MaxMessages: 3, OnEvict: recorder.record})
+	defer s.Close()
+	now := time.Now().Unix()
+	for i := 0; i < 3; i++ {
+		s.Add(&arbor.ChatMessage{UUID: strconv.Itoa(i), Timestamp: now})
+	}
+	// accessing "0" makes "1" the least recently used message
+	g.Expect(s.Get("0")).ToNot(gomega.BeNil())
+	s.Add(&arbor.ChatMessage{UUID: "3", Timestamp: now})
+	g.Expect(s.Has("1")).To(gomega.BeFalse())
+	g.Expect(recorder.ids()).To(gomega.Equal([]string{"1"}))
+	for _, id := range []string{"0", "2", "3"} {
+		g.Expect(s.Has(id)).To(gomega.BeTrue())
+	}
+}
+
+// TestBoundedStorePinning ensures that the root and the most recent leaves are never
+// evicted.
+func TestBoundedStorePinning(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	recorder := &evictionRecorder{}
+	s := arbor.NewBoundedStore(arbor.StoreLimits{MaxMessages: 3, PinRecent: 1, OnEvict: recorder.record})
+	defer s.Close()
+	s.SetRoot("root")
+	s.Add(&arbor.ChatMessage{UUID: "root", Timestamp: 1})
+	s.Add(&arbor.ChatMessage{UUID: "a", Parent: "root", Timestamp: 2})
+	s.Add(&arbor.ChatMessage{UUID: "leaf", Parent: "a", Timestamp: 10})
+	s.Add(&arbor.ChatMessage{UUID: "b", Parent: "root", Timestamp: 3})
+	// "root" is least recently used and "leaf" is the newest leaf, so "a" goes
+	for _, id := range []string{"root", "leaf", "b"} {
+		g.Expect(s.Has(id)).To(gomega.BeTrue())
+	}
+	g.Expect(recorder.ids()).To(gomega.Equal([]string{"a"}))
+}
+
+// TestBoundedStorePinRecent ensures that only the requested number of most recent
+// leaves are pinned, regardless of the order in which they were added.
+func TestBoundedStorePinRecent(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	recorder := &evictionRecorder{}
+	s := arbor.NewBoundedStore(arbor.StoreLimits{MaxMessages: 4, PinRecent: 2, OnEvict: recorder.record})
+	defer s.Close()
+	for i, timestamp := range []int64{5, 1, 4, 2, 3, 0} {
+		s.Add(&arbor.ChatMessage{UUID: strconv.Itoa(i), Timestamp: timestamp})
+	}
+	// "0" and "2" are the newest leaves, so the least recently used of the
+	// others are evicted
+	for _, id := range []string{"0", "2", "4", "5"} {
+		g.Expect(s.Has(id)).To(gomega.BeTrue())
+	}
+	g.Expect(recorder.ids()).To(gomega.Equal([]string{"1", "3"}))
+}
+
+// TestBoundedStoreMaxAge ensures that messages older than the maximum age are evicted.
+func TestBoundedStoreMaxAge(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	recorder := &evictionRecorder{}
+	s := arbor.NewBoundedStore(arbor.StoreLimits{MaxAge: time.Hour, OnEvict: recorder.record})
+	defer s.Close()
+	s.SetRoot("root")
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	s.Add(&arbor.ChatMessage{UUID: "root", Timestamp: old})
+	s.Add(&arbor.ChatMessage{UUID: "old", Parent: "root", Timestamp: old})
+	s.Add(&arbor.ChatMessage{UUID: "new", Parent: "root", Timestamp: time.Now().Unix()})
+	g.Expect(s.Has("root")).To(gomega.BeTrue())
+	g.Expect(s.Has("new")).To(gomega.BeTrue())
+	g.Expect(recorder.ids()).To(gomega.Equal([]string{"old"}))
+}
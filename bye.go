@@ -0,0 +1,80 @@
+package arbor
+
+import (
+	"fmt"
+	"time"
+)
+
+// Standard values for the Code field of BYE messages. Applications may define
+// their own reasons as well.
+const (
+	// ReasonQuit means that the user chose to disconnect.
+	ReasonQuit = "quit"
+	// ReasonShutdown means that the sender is shutting down and will not
+	// return soon.
+	ReasonShutdown = "shutdown"
+	// ReasonRestart means that the sender is restarting. Reconnecting after
+	// RetryAfter seconds is expected to succeed.
+	ReasonRestart = "restart"
+	// ReasonBanned means that the peer is not welcome and should not
+	// reconnect.
+	ReasonBanned = "banned"
+	// ReasonProtocolError means that the peer broke the protocol.
+	ReasonProtocolError = "protocol-error"
+	// ReasonTimeout means that the peer stopped responding.
+	ReasonTimeout = "timeout"
+)
+
+// byeTimeout limits how long closing a ProtocolReadWriter waits to send a BYE
+// to an unresponsive peer.
+const byeTimeout = time.Second
+
+// NewBye creates a BYE message announcing that the connection is about to be
+// closed for the given reason. If the peer may reconnect later, retryAfter
+// should be how long it ought to wait first. It is rounded up to whole
+// seconds. Otherwise, retryAfter should be zero.
+func NewBye(reason, text string, retryAfter time.Duration) *ProtocolMessage {
+	return &ProtocolMessage{
+		Type:       ByeType,
+		Code:       reason,
+		Text:       text,
+		RetryAfter: int64((retryAfter + time.Second - 1) / time.Second),
+	}
+}
+
+// WithByeOnClose makes the Close method of a ProtocolReadWriter send the
+// given BYE message to the peer before closing the connection.
+func WithByeOnClose(bye *ProtocolMessage) Option {
+	return func(o *options) {
+		o.bye = bye
+	}
+}
+
+// CloseWithBye sends the given BYE message to the peer and then closes the
+// ProtocolReadWriter (see Close). It is used in place of any BYE configured
+// with WithByeOnClose. Failure to send the BYE does not prevent the
+// connection from being closed and is not reported.
+func (c *ProtocolReadWriter) CloseWithBye(bye *ProtocolMessage) error {
+	if bye == nil || bye.Type != ByeType {
+		return fmt.Errorf("CloseWithBye requires a BYE message")
+	}
+	if err := bye.Validate(); err != nil {
+		return err
+	}
+	c.farewell(bye)
+	return c.shutdown()
+}
+
+// farewell sends the BYE message, giving up if the peer does not accept it
+// within byeTimeout.
+func (c *ProtocolReadWriter) farewell(bye *ProtocolMessage) {
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		_ = c.ProtocolWriter.Write(bye)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(byeTimeout):
+	}
+}
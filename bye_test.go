@@ -0,0 +1,65 @@
+package arbor_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// TestByeMessage ensures that BYE messages validate and survive serialization.
+func TestByeMessage(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	bye := arbor.NewBye(arbor.ReasonRestart, "Upgrading", 1500*time.Millisecond)
+	g.Expect(bye.RetryAfter).To(gomega.Equal(int64(2)))
+	for _, msg := range []*arbor.ProtocolMessage{bye, arbor.NewBye(arbor.ReasonBanned, "", 0)} {
+		g.Expect(msg.Validate()).To(gomega.Succeed())
+		decoded := &arbor.ProtocolMessage{}
+		g.Expect(arbor.UnmarshalProtocolMessage([]byte(marshalOrFail(t, msg)), decoded, arbor.DecodeStrict)).To(gomega.Succeed())
+		g.Expect(decoded.Equals(msg)).To(gomega.BeTrue(), "expected %v, got %v", msg, decoded)
+	}
+	g.Expect(arbor.NewBye("", "No reason", 0).IsValid()).To(gomega.BeFalse())
+	bye.RetryAfter = -1
+	g.Expect(bye.IsValid()).To(gomega.BeFalse())
+}
+
+// TestByeOnClose ensures that closing a ProtocolReadWriter sends the configured BYE.
+func TestByeOnClose(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	bye := arbor.NewBye(arbor.ReasonShutdown, "Goodbye", 0)
+	server, client := connectedPair(t, arbor.WithByeOnClose(bye))
+	defer client.Close()
+	go func() { _ = server.Close() }()
+	received := new(arbor.ProtocolMessage)
+	g.Expect(client.Read(received)).To(gomega.Succeed())
+	g.Expect(received.Equals(bye)).To(gomega.BeTrue())
+}
+
+// TestCloseWithBye ensures that CloseWithBye sends its BYE and refuses other messages.
+func TestCloseWithBye(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server, client := connectedPair(t)
+	defer client.Close()
+	g.Expect(server.CloseWithBye(getNew())).ToNot(gomega.Succeed())
+
+	bye := arbor.NewBye(arbor.ReasonRestart, "", time.Minute)
+	go func() { _ = server.CloseWithBye(bye) }()
+	received := new(arbor.ProtocolMessage)
+	g.Expect(client.Read(received)).To(gomega.Succeed())
+	g.Expect(received.Equals(bye)).To(gomega.BeTrue())
+}
+
+// TestByeUnresponsivePeer ensures that Close does not hang when the peer never reads
+// the BYE.
+func TestByeUnresponsivePeer(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	peerConn, conn := net.Pipe()
+	defer peerConn.Close()
+	rw, err := arbor.NewProtocolReadWriter(conn, arbor.WithByeOnClose(arbor.NewBye(arbor.ReasonQuit, "", 0)))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	closed := make(chan error)
+	go func() { closed <- rw.Close() }()
+	g.Eventually(closed, 2*time.Second).Should(gomega.Receive())
+}
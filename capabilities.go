@@ -0,0 +1,146 @@
+package arbor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Keys used within the Meta field of META messages to advertise capabilities.
+// List values are comma-separated.
+const (
+	// MetaKeyExtensions lists the optional protocol extensions supported by the sender.
+	MetaKeyExtensions = "arbor.capabilities.extensions"
+	// MetaKeyEncodings lists the message encodings supported by the sender, most preferred first.
+	MetaKeyEncodings = "arbor.capabilities.encodings"
+	// MetaKeyMaxMessageSize is the size in bytes of the largest message that the sender will accept.
+	MetaKeyMaxMessageSize = "arbor.capabilities.max-message-size"
+	// MetaKeyFramings lists the names of the Framings supported by the sender, most preferred first.
+	MetaKeyFramings = "arbor.capabilities.framings"
+)
+
+// Capabilities describes the optional features supported by one side of a
+// connection. Peers exchange their Capabilities in META messages (see Meta and
+// ParseCapabilities) and enable only the features in the Intersection of the
+// two sets.
+type Capabilities struct {
+	// Extensions names the optional protocol extensions supported.
+	Extensions []string
+	// Encodings names the message encodings supported, most preferred first.
+	Encodings []string
+	// MaxMessageSize is the size in bytes of the largest message that will be
+	// accepted. Zero means that no limit is advertised.
+	MaxMessageSize int
+	// Framings names the Framings supported, most preferred first. Every peer
+	// supports FramingNewline whether or not it is listed.
+	Framings []string
+}
+
+// Meta creates a META message advertising the capabilities.
+func (c Capabilities) Meta() *ProtocolMessage {
+	meta := map[string]string{}
+	if len(c.Extensions) > 0 {
+		meta[MetaKeyExtensions] = strings.Join(c.Extensions, ",")
+	}
+	if len(c.Encodings) > 0 {
+		meta[MetaKeyEncodings] = strings.Join(c.Encodings, ",")
+	}
+	if len(c.Framings) > 0 {
+		meta[MetaKeyFramings] = strings.Join(c.Framings, ",")
+	}
+	if c.MaxMessageSize > 0 {
+		meta[MetaKeyMaxMessageSize] = strconv.Itoa(c.MaxMessageSize)
+	}
+	return &ProtocolMessage{Type: MetaType, Meta: meta}
+}
+
+// ParseCapabilities extracts the capabilities advertised in a META message.
+// Capabilities that are not mentioned are left empty, and Meta keys that are
+// not related to capabilities are ignored.
+func ParseCapabilities(m *ProtocolMessage) (Capabilities, error) {
+	if m == nil || m.Type != MetaType {
+		return Capabilities{}, fmt.Errorf("Capabilities can only be parsed from META messages")
+	}
+	c := Capabilities{
+		Extensions: splitList(m.Meta[MetaKeyExtensions]),
+		Encodings:  splitList(m.Meta[MetaKeyEncodings]),
+		Framings:   splitList(m.Meta[MetaKeyFramings]),
+	}
+	if size, ok := m.Meta[MetaKeyMaxMessageSize]; ok {
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed < 0 {
+			return Capabilities{}, fmt.Errorf("Invalid %s %q", MetaKeyMaxMessageSize, size)
+		}
+		c.MaxMessageSize = parsed
+	}
+	return c, nil
+}
+
+// splitList parses a comma-separated list, discarding empty entries.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Supports reports whether the named extension is among the capabilities.
+func (c Capabilities) Supports(extension string) bool {
+	return contains(c.Extensions, extension)
+}
+
+// PreferredFraming returns the first of the Framings known to this package,
+// or FramingNewline if there is none. Call it on the result of Intersect to
+// choose the framing for a connection.
+func (c Capabilities) PreferredFraming() Framing {
+	for _, name := range c.Framings {
+		if framing, err := ParseFraming(name); err == nil {
+			return framing
+		}
+	}
+	return FramingNewline
+}
+
+// Intersect returns the capabilities shared by c and peer. Encodings and
+// Framings keep the order of preference given by c, and the smaller nonzero
+// MaxMessageSize is used.
+func (c Capabilities) Intersect(peer Capabilities) Capabilities {
+	shared := Capabilities{
+		Extensions: intersect(c.Extensions, peer.Extensions),
+		Encodings:  intersect(c.Encodings, peer.Encodings),
+		Framings:   intersect(c.Framings, peer.Framings),
+	}
+	switch {
+	case c.MaxMessageSize == 0:
+		shared.MaxMessageSize = peer.MaxMessageSize
+	case peer.MaxMessageSize == 0 || c.MaxMessageSize < peer.MaxMessageSize:
+		shared.MaxMessageSize = c.MaxMessageSize
+	default:
+		shared.MaxMessageSize = peer.MaxMessageSize
+	}
+	return shared
+}
+
+// contains reports whether list includes item.
+func contains(list []string, item string) bool {
+	for _, candidate := range list {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
+
+// intersect returns the items of a that are also in b, in the order of a.
+func intersect(a, b []string) []string {
+	var shared []string
+	for _, item := range a {
+		if contains(b, item) && !contains(shared, item) {
+			shared = append(shared, item)
+		}
+	}
+	return shared
+}
@@ -0,0 +1,70 @@
+package arbor_test
+
+import (
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// TestCapabilitiesRoundTrip ensures that capabilities survive being advertised in a
+// META message.
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	caps := arbor.Capabilities{
+		Extensions:     []string{"edit", "search"},
+		Encodings:      []string{"cbor", "json"},
+		MaxMessageSize: 4096,
+		Framings:       []string{"varint", "newline"},
+	}
+	meta := caps.Meta()
+	g.Expect(meta.IsValidMeta()).To(gomega.BeTrue())
+	parsed, err := arbor.ParseCapabilities(meta)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(parsed).To(gomega.Equal(caps))
+	g.Expect(parsed.Supports("edit")).To(gomega.BeTrue())
+	g.Expect(parsed.Supports("delete")).To(gomega.BeFalse())
+
+	empty := arbor.Capabilities{}.Meta()
+	g.Expect(empty.IsValidMeta()).To(gomega.BeTrue())
+	parsed, err = arbor.ParseCapabilities(empty)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(parsed).To(gomega.Equal(arbor.Capabilities{}))
+}
+
+// TestParseCapabilitiesInvalid ensures that malformed advertisements are rejected.
+func TestParseCapabilitiesInvalid(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	_, err := arbor.ParseCapabilities(getNew())
+	g.Expect(err).To(gomega.HaveOccurred())
+	bad := getMeta()
+	bad.Meta[arbor.MetaKeyMaxMessageSize] = "large"
+	_, err = arbor.ParseCapabilities(bad)
+	g.Expect(err).To(gomega.HaveOccurred())
+	// unrelated keys and stray commas are tolerated
+	odd := getMeta()
+	odd.Meta[arbor.MetaKeyExtensions] = " edit,,search "
+	parsed, err := arbor.ParseCapabilities(odd)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(parsed.Extensions).To(gomega.Equal([]string{"edit", "search"}))
+}
+
+// TestCapabilitiesIntersect ensures that only features supported by both peers are
+// enabled.
+func TestCapabilitiesIntersect(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	local := arbor.Capabilities{Extensions: []string{"edit", "search"}, Encodings: []string{"cbor", "msgpack", "json"}}
+	peer := arbor.Capabilities{Extensions: []string{"search", "bye"}, Encodings: []string{"json", "cbor"}, MaxMessageSize: 1024}
+	shared := local.Intersect(peer)
+	g.Expect(shared.Extensions).To(gomega.Equal([]string{"search"}))
+	g.Expect(shared.Encodings).To(gomega.Equal([]string{"cbor", "json"}))
+	g.Expect(shared.MaxMessageSize).To(gomega.Equal(1024))
+	local.MaxMessageSize = 512
+	g.Expect(local.Intersect(peer).MaxMessageSize).To(gomega.Equal(512))
+	g.Expect(local.Intersect(arbor.Capabilities{}).Extensions).To(gomega.BeEmpty())
+
+	local.Framings = []string{"varint", "newline"}
+	g.Expect(local.Intersect(peer).PreferredFraming()).To(gomega.Equal(arbor.FramingNewline))
+	peer.Framings = []string{"newline", "varint"}
+	g.Expect(local.Intersect(peer).PreferredFraming()).To(gomega.Equal(arbor.FramingVarint))
+}
@@ -0,0 +1,204 @@
+package arbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// CBOR major types (RFC 7049, section 2.1)
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborSimple = 7
+)
+
+// encodeCBOR encodes a JSON value tree as CBOR.
+func encodeCBOR(tree interface{}) ([]byte, error) {
+	return appendCBOR(nil, tree)
+}
+
+// appendCBORHead appends the initial bytes of a data item.
+func appendCBORHead(buf []byte, major byte, arg uint64) []byte {
+	major <<= 5
+	switch {
+	case arg < 24:
+		return append(buf, major|byte(arg))
+	case arg <= math.MaxUint8:
+		return appendUint(append(buf, major|24), arg, 1)
+	case arg <= math.MaxUint16:
+		return appendUint(append(buf, major|25), arg, 2)
+	case arg <= math.MaxUint32:
+		return appendUint(append(buf, major|26), arg, 4)
+	default:
+		return appendUint(append(buf, major|27), arg, 8)
+	}
+}
+
+func appendCBOR(buf []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, 0xf6), nil
+	case bool:
+		if v {
+			return append(buf, 0xf5), nil
+		}
+		return append(buf, 0xf4), nil
+	case string:
+		return append(appendCBORHead(buf, cborText, uint64(len(v))), v...), nil
+	case json.Number:
+		kind, i, u, f, err := number(v)
+		switch {
+		case err != nil:
+			return nil, err
+		case kind == 'i' && i < 0:
+			return appendCBORHead(buf, cborNegInt, uint64(-1-i)), nil
+		case kind == 'i':
+			return appendCBORHead(buf, cborUint, uint64(i)), nil
+		case kind == 'u':
+			return appendCBORHead(buf, cborUint, u), nil
+		default:
+			return appendUint(append(buf, 0xfb), math.Float64bits(f), 8), nil
+		}
+	case []interface{}:
+		buf = appendCBORHead(buf, cborArray, uint64(len(v)))
+		for _, item := range v {
+			var err error
+			if buf, err = appendCBOR(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		buf = appendCBORHead(buf, cborMap, uint64(len(v)))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			buf = append(appendCBORHead(buf, cborText, uint64(len(key))), key...)
+			var err error
+			if buf, err = appendCBOR(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	default:
+		return nil, fmt.Errorf("Cannot encode %T as CBOR", value)
+	}
+}
+
+// decodeCBOR decodes a single CBOR data item into a JSON value tree.
+func decodeCBOR(data []byte) (interface{}, error) {
+	d := &treeDecoder{data: data}
+	return d.finish(d.cbor(0))
+}
+
+func (d *treeDecoder) cbor(depth int) (interface{}, error) {
+	if depth > maxTreeDepth {
+		return nil, fmt.Errorf("CBOR nested too deeply")
+	}
+	initial, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := initial[0]>>5, initial[0]&0x1f
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		if arg, err = d.uint(1 << (info - 24)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported CBOR additional information %d", info)
+	}
+	switch major {
+	case cborUint:
+		return json.Number(strconv.FormatUint(arg, 10)), nil
+	case cborNegInt:
+		if arg > math.MaxInt64 {
+			return nil, fmt.Errorf("CBOR integer out of range")
+		}
+		return json.Number(strconv.FormatInt(-1-int64(arg), 10)), nil
+	case cborText:
+		text, err := d.take(arg)
+		return string(text), err
+	case cborArray:
+		n, err := d.count(arg)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = d.cbor(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case cborMap:
+		n, err := d.count(arg)
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			key, err := d.cbor(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("CBOR map keys must be text")
+			}
+			if fields[name], err = d.cbor(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return fields, nil
+	case cborSimple:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		case 25:
+			return floatNumber(halfFloat(uint16(arg)))
+		case 26:
+			return floatNumber(float64(math.Float32frombits(uint32(arg))))
+		case 27:
+			return floatNumber(math.Float64frombits(arg))
+		}
+	}
+	return nil, fmt.Errorf("Unsupported CBOR data item 0x%x", initial[0])
+}
+
+// halfFloat converts an IEEE 754 half-precision number to a float64.
+func halfFloat(bits uint16) float64 {
+	exponent, mantissa := int(bits>>10)&0x1f, float64(bits&0x3ff)
+	var value float64
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		value = math.Inf(1)
+		if mantissa != 0 {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if bits&0x8000 != 0 {
+		value = -value
+	}
+	return value
+}
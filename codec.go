@@ -0,0 +1,244 @@
+package arbor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Codec converts ProtocolMessages to and from bytes. JSONCodec is used unless
+// another is chosen with WithCodec. Peers must use the same codec, so choose
+// one that both support, usually by advertising codec names in
+// Capabilities.Encodings.
+type Codec interface {
+	// Name identifies the codec in Capabilities.Encodings.
+	Name() string
+	// Marshal encodes the message.
+	Marshal(*ProtocolMessage) ([]byte, error)
+	// Unmarshal decodes data into the message, handling fields that the
+	// message's type does not use as described by mode.
+	Unmarshal(data []byte, m *ProtocolMessage, mode DecodeMode) error
+}
+
+var (
+	// JSONCodec encodes messages as JSON, the standard Arbor encoding.
+	JSONCodec Codec = jsonCodec{}
+	// CBORCodec encodes messages as CBOR (RFC 7049), a compact binary
+	// encoding of the same structure used by JSONCodec.
+	CBORCodec Codec = &treeCodec{name: "cbor", encode: encodeCBOR, decode: decodeCBOR}
+	// MsgPackCodec encodes messages as MessagePack, a compact binary encoding
+	// of the same structure used by JSONCodec.
+	MsgPackCodec Codec = &treeCodec{name: "msgpack", encode: encodeMsgPack, decode: decodeMsgPack}
+)
+
+// CodecByName returns the codec built into this package with the given name.
+func CodecByName(name string) (Codec, bool) {
+	for _, codec := range []Codec{JSONCodec, CBORCodec, MsgPackCodec} {
+		if codec.Name() == name {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// WithCodec sets the codec used by a reader or writer. The default is
+// JSONCodec. Every other codec may produce newlines within a message, so it
+// always uses FramingVarint.
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// lengthPrefixed reports whether the codec requires FramingVarint.
+func lengthPrefixed(codec Codec) bool {
+	_, text := codec.(jsonCodec)
+	return !text
+}
+
+// checkFraming returns an error if the codec cannot be used with the framing.
+func checkFraming(codec Codec, framing Framing) error {
+	if lengthPrefixed(codec) && framing != FramingVarint {
+		return fmt.Errorf("Codec %s requires %v framing, not %v", codec.Name(), FramingVarint, framing)
+	}
+	return nil
+}
+
+// jsonEncoder is implemented by codecs that encode messages by way of their
+// JSON representation.
+type jsonEncoder interface {
+	// fromJSON encodes a message given its JSON representation.
+	fromJSON([]byte) ([]byte, error)
+}
+
+// encodeMessage encodes the message with the codec. If passthrough is true,
+// messages of unregistered types are encoded with every field that is set.
+func encodeMessage(msg *ProtocolMessage, codec Codec, passthrough bool) ([]byte, error) {
+	if _, registered := LookupType(msg.Type); registered || !passthrough {
+		return codec.Marshal(msg)
+	}
+	encoder, ok := codec.(jsonEncoder)
+	if !ok {
+		return nil, fmt.Errorf("Codec %s cannot encode unregistered message type %d", codec.Name(), msg.Type)
+	}
+	data, err := msg.marshalWith(passthroughSpec)
+	if err != nil {
+		return nil, err
+	}
+	return encoder.fromJSON(data)
+}
+
+// jsonCodec implements JSONCodec.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(m *ProtocolMessage) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (jsonCodec) fromJSON(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (jsonCodec) Unmarshal(data []byte, m *ProtocolMessage, mode DecodeMode) error {
+	return UnmarshalProtocolMessage(data, m, mode)
+}
+
+// treeCodec is a codec for an encoding of the values that JSON can
+// represent. Messages are converted to and from JSON, so that they behave
+// exactly as they do with JSONCodec. Values are nil, bool, string,
+// json.Number, []interface{}, or map[string]interface{}.
+type treeCodec struct {
+	name   string
+	encode func(interface{}) ([]byte, error)
+	decode func([]byte) (interface{}, error)
+}
+
+func (c *treeCodec) Name() string {
+	return c.name
+}
+
+func (c *treeCodec) Marshal(m *ProtocolMessage) ([]byte, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return c.fromJSON(data)
+}
+
+func (c *treeCodec) fromJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+	return c.encode(tree)
+}
+
+func (c *treeCodec) Unmarshal(data []byte, m *ProtocolMessage, mode DecodeMode) error {
+	if m == nil {
+		return fmt.Errorf("Cannot unmarshal into nil ProtocolMessage")
+	}
+	tree, err := c.decode(data)
+	if err != nil {
+		return err
+	}
+	if _, ok := tree.(map[string]interface{}); !ok {
+		return fmt.Errorf("Invalid %s message: not a map", c.name)
+	}
+	data, err = json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return UnmarshalProtocolMessage(data, m, mode)
+}
+
+// maxTreeDepth limits the nesting of decoded values, so that malicious input
+// cannot exhaust the stack.
+const maxTreeDepth = 32
+
+// number classifies a JSON number as the integer or floating point value that
+// best represents it. Exactly one of the results is meaningful, as indicated
+// by kind.
+func number(n json.Number) (kind byte, i int64, u uint64, f float64, err error) {
+	if i, err = strconv.ParseInt(string(n), 10, 64); err == nil {
+		return 'i', i, 0, 0, nil
+	}
+	if u, err = strconv.ParseUint(string(n), 10, 64); err == nil {
+		return 'u', 0, u, 0, nil
+	}
+	if f, err = strconv.ParseFloat(string(n), 64); err == nil {
+		return 'f', 0, 0, f, nil
+	}
+	return 0, 0, 0, 0, fmt.Errorf("Invalid number %s", n)
+}
+
+// floatNumber converts a decoded floating point value to a json.Number.
+func floatNumber(f float64) (json.Number, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("Unsupported number %v", f)
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
+
+// treeDecoder holds the state shared by the decoders of binary encodings.
+type treeDecoder struct {
+	data []byte
+	pos  int
+}
+
+// take consumes and returns the next n bytes.
+func (d *treeDecoder) take(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("Unexpected end of data")
+	}
+	taken := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return taken, nil
+}
+
+// uint reads a big-endian unsigned integer of the given width in bytes.
+func (d *treeDecoder) uint(width int) (uint64, error) {
+	raw, err := d.take(uint64(width))
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, b := range raw {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+// count checks that a container of n elements could fit in the remaining
+// data, so that its length does not cause an enormous allocation.
+func (d *treeDecoder) count(n uint64) (int, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, fmt.Errorf("Unexpected end of data")
+	}
+	return int(n), nil
+}
+
+// finish checks that all of the data was consumed.
+func (d *treeDecoder) finish(tree interface{}, err error) (interface{}, error) {
+	if err == nil && d.pos != len(d.data) {
+		err = fmt.Errorf("Unexpected data after message")
+	}
+	return tree, err
+}
+
+// appendUint appends value to buf as a big-endian integer of the given width
+// in bytes.
+func appendUint(buf []byte, value uint64, width int) []byte {
+	for shift := uint(8 * (width - 1)); width > 0; width-- {
+		buf = append(buf, byte(value>>shift))
+		shift -= 8
+	}
+	return buf
+}
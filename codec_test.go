@@ -0,0 +1,147 @@
+package arbor_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/jordwest/mock-conn"
+	"github.com/onsi/gomega"
+)
+
+// codecs lists every codec built into the package.
+var codecs = []arbor.Codec{arbor.JSONCodec, arbor.CBORCodec, arbor.MsgPackCodec}
+
+// everyType returns a valid message of every built-in type.
+func everyType() []*arbor.ProtocolMessage {
+	return []*arbor.ProtocolMessage{
+		getWelcome(),
+		getQuery(),
+		getNew(),
+		getMeta(),
+		arbor.NewEdit(testID1, testUser, "Edited"),
+		arbor.NewDelete(testID1, testUser),
+		arbor.NewBatchQuery(testID1, testID2),
+		arbor.NewAncestorsQuery(testID1, 3),
+		arbor.NewDescendantsQuery(testID1, 1537738224),
+		arbor.NewPing("7"),
+		arbor.NewPong(arbor.NewPing("7")),
+		arbor.NewError(arbor.CodeRateLimited, "Slow down", testID1),
+		arbor.NewBye(arbor.ReasonRestart, "Back soon", time.Minute),
+	}
+}
+
+// TestCodecRoundTrip ensures that every message type survives every codec.
+func TestCodecRoundTrip(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, codec := range codecs {
+		for _, msg := range everyType() {
+			data, err := codec.Marshal(msg)
+			g.Expect(err).ToNot(gomega.HaveOccurred())
+			decoded := new(arbor.ProtocolMessage)
+			g.Expect(codec.Unmarshal(data, decoded, arbor.DecodeStrict)).To(gomega.Succeed())
+			g.Expect(decoded.Equals(msg)).To(gomega.BeTrue(), "%s: expected %v, got %v", codec.Name(), msg, decoded)
+		}
+		named, ok := arbor.CodecByName(codec.Name())
+		g.Expect(ok).To(gomega.BeTrue())
+		g.Expect(named).To(gomega.Equal(codec))
+	}
+	_, ok := arbor.CodecByName("xml")
+	g.Expect(ok).To(gomega.BeFalse())
+}
+
+// TestCodecValues ensures that the binary codecs preserve numbers, nesting, and other
+// values that only appear in unrecognized fields.
+func TestCodecValues(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	extra := `{"Type":1,"UUID":"a","n":-300,"small":-5,"f":1.5,"big":18446744073709551615,"min":-9223372036854775808,` +
+		`"list":[true,false,null,"x",[],{}],"long":"` + string(bytes.Repeat([]byte("y"), 70000)) + `"}`
+	msg := new(arbor.ProtocolMessage)
+	g.Expect(arbor.UnmarshalProtocolMessage([]byte(extra), msg, arbor.DecodePreserve)).To(gomega.Succeed())
+	for _, codec := range codecs {
+		data, err := codec.Marshal(msg)
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		decoded := new(arbor.ProtocolMessage)
+		g.Expect(codec.Unmarshal(data, decoded, arbor.DecodePreserve)).To(gomega.Succeed())
+		g.Expect(decoded.Equals(msg)).To(gomega.BeTrue())
+		g.Expect(decoded.Extra).To(gomega.HaveLen(len(msg.Extra)))
+		for key, value := range msg.Extra {
+			g.Expect(decoded.Extra[key]).To(gomega.MatchJSON(value), "%s: field %s", codec.Name(), key)
+		}
+	}
+}
+
+// TestBinaryEncodings checks the binary codecs against hand-encoded messages.
+func TestBinaryEncodings(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	query := arbor.NewQuery("ab")
+	cbor := append([]byte{0xa2, 0x64}, "Type\x01\x64UUID\x62ab"...)
+	msgpack := append([]byte{0x82, 0xa4}, "Type\x01\xa4UUID\xa2ab"...)
+	for codec, expected := range map[arbor.Codec][]byte{arbor.CBORCodec: cbor, arbor.MsgPackCodec: msgpack} {
+		data, err := codec.Marshal(query)
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		g.Expect(data).To(gomega.Equal(expected), codec.Name())
+		jsonData, _ := json.Marshal(getNew())
+		data, _ = codec.Marshal(getNew())
+		g.Expect(len(data)).To(gomega.BeNumerically("<", len(jsonData)))
+	}
+}
+
+// TestBinaryMalformed ensures that malformed binary input produces errors.
+func TestBinaryMalformed(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for codec, inputs := range map[arbor.Codec][][]byte{
+		arbor.CBORCodec: {
+			{},
+			{0xa2, 0x64, 'T'}, // truncated
+			{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, // enormous array
+			{0x01},                              // not a map
+			{0xa1, 0x01, 0x01},                  // non-text key
+			{0xa0, 0xa0},                        // trailing data
+			{0xa1, 0x61, 'x', 0xf9, 0x7c, 0x00}, // infinity
+		},
+		arbor.MsgPackCodec: {
+			{},
+			{0x82, 0xa4, 'T'},
+			{0xdd, 0xff, 0xff, 0xff, 0xff},
+			{0x01},
+			{0x81, 0x01, 0x01},
+			{0x80, 0x80},
+			{0x81, 0xa1, 'x', 0xc1}, // never used
+		},
+	} {
+		for _, input := range inputs {
+			g.Expect(codec.Unmarshal(input, new(arbor.ProtocolMessage), arbor.DecodeLenient)).ToNot(gomega.Succeed(), "%s: % x", codec.Name(), input)
+		}
+	}
+}
+
+// TestCodecReadWrite ensures that readers and writers use the chosen codec with
+// length-prefixed framing.
+func TestCodecReadWrite(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, codec := range codecs[1:] {
+		buf := new(bytes.Buffer)
+		writer, err := arbor.NewProtocolWriter(buf, arbor.WithCodec(codec))
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		g.Expect(writer.SwitchFraming(arbor.FramingNewline)).ToNot(gomega.Succeed())
+		for _, msg := range everyType() {
+			g.Expect(writer.Write(msg)).To(gomega.Succeed())
+		}
+		reader, err := arbor.NewProtocolReader(buf, arbor.WithCodec(codec), arbor.WithDecodeMode(arbor.DecodeStrict))
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		for _, msg := range everyType() {
+			received := new(arbor.ProtocolMessage)
+			g.Expect(reader.Read(received)).To(gomega.Succeed())
+			g.Expect(received.Equals(msg)).To(gomega.BeTrue(), "%s: expected %v, got %v", codec.Name(), msg, received)
+		}
+
+		conn := mock_conn.NewConn()
+		output := arbor.MakeMessageWriter(conn.Server, arbor.WithCodec(codec))
+		input := arbor.MakeMessageReader(conn.Client, arbor.WithCodec(codec))
+		output <- getNew()
+		g.Expect((<-input).Equals(getNew())).To(gomega.BeTrue())
+	}
+}
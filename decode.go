@@ -0,0 +1,128 @@
+package arbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// DecodeMode controls how UnmarshalProtocolMessage treats JSON fields that are
+// not used by the type of the message being decoded.
+type DecodeMode int
+
+const (
+	// DecodeLenient silently discards fields that are unknown to this package.
+	// Fields of ProtocolMessage that the message's type does not use are
+	// decoded anyway, so that Validate can reject invalid combinations. This
+	// is the mode used by ProtocolMessage.UnmarshalJSON.
+	DecodeLenient DecodeMode = iota
+	// DecodeStrict rejects messages containing any field that is not used by
+	// the message's type with a *ValidationError.
+	DecodeStrict
+	// DecodePreserve is like DecodeLenient, but keeps fields unknown to this
+	// package in the message's Extra map so that they survive being forwarded
+	// to another peer.
+	DecodePreserve
+)
+
+// knownFields holds the JSON keys of every ProtocolMessage field, lowercased.
+var knownFields = jsonFields(reflect.TypeOf(ProtocolMessage{}))
+
+// jsonFields lists the lowercased JSON keys used by the fields of a struct
+// type, including the fields of embedded structs.
+func jsonFields(structType reflect.Type) map[string]struct{} {
+	fields := map[string]struct{}{}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			for name := range jsonFields(embedded) {
+				fields[name] = struct{}{}
+			}
+			continue
+		}
+		name := field.Name
+		if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+			name = tagName
+		}
+		fields[strings.ToLower(name)] = struct{}{}
+	}
+	return fields
+}
+
+// plainMessage has the same fields as ProtocolMessage but none of its methods,
+// so that it can be decoded with the default behavior of encoding/json.
+type plainMessage ProtocolMessage
+
+// UnmarshalProtocolMessage decodes the JSON in data into m according to the rules
+// of the message's Type. Fields that are not used by the message's type (as
+// listed in its TypeSpec) are handled according to mode. Messages of unknown
+// types are decoded with every field present. Any previous contents of m are
+// discarded. Decoding does not validate the message; see Validate.
+func UnmarshalProtocolMessage(data []byte, m *ProtocolMessage, mode DecodeMode) error {
+	if m == nil {
+		return fmt.Errorf("Cannot unmarshal into nil ProtocolMessage")
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	var messageType uint8
+	for key, value := range fields {
+		if strings.EqualFold(key, "Type") {
+			if err := json.Unmarshal(value, &messageType); err != nil {
+				return err
+			}
+		}
+	}
+	var extra map[string]json.RawMessage
+	if spec, ok := LookupType(messageType); ok && spec.Fields != nil {
+		for key, value := range fields {
+			if strings.EqualFold(key, "Type") || spec.uses(key) {
+				continue
+			}
+			_, known := knownFields[strings.ToLower(key)]
+			switch {
+			case mode == DecodeStrict:
+				return &ValidationError{Type: messageType, Field: key, Problem: FieldUnexpected}
+			case mode == DecodePreserve && !known:
+				if extra == nil {
+					extra = make(map[string]json.RawMessage)
+				}
+				extra[key] = value
+			}
+		}
+	}
+	// nothing from a message previously held in m may survive
+	*m = ProtocolMessage{}
+	if err := json.Unmarshal(data, (*plainMessage)(m)); err != nil {
+		return err
+	}
+	m.Extra = extra
+	return nil
+}
+
+// uses reports whether the JSON key belongs to the type described by spec.
+func (spec TypeSpec) uses(key string) bool {
+	for _, field := range spec.Fields {
+		if strings.EqualFold(field, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON decodes a ProtocolMessage from JSON as described by
+// DecodeLenient. Use UnmarshalProtocolMessage for control over how fields
+// that are not used by the message's type are handled.
+func (m *ProtocolMessage) UnmarshalJSON(data []byte) error {
+	return UnmarshalProtocolMessage(data, m, DecodeLenient)
+}
@@ -0,0 +1,109 @@
+package arbor_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// newWithExtras is a NEW message carrying a WELCOME-only field and a field unknown
+// to the protocol.
+const newWithExtras = `{"Type":2,"UUID":"id","Parent":"parent","Content":"hi","Username":"user","Timestamp":1,"Root":"root","Future":{"a":1}}`
+
+// newWithMeta is a NEW message carrying a field that NEW messages may not have.
+const newWithMeta = `{"Type":2,"UUID":"id","Parent":"parent","Content":"hi","Username":"user","Timestamp":1,"Meta":{"key":"value"}}`
+
+// TestUnmarshalJSONLenient ensures that default decoding drops unknown fields but
+// keeps fields of other message types, so that invalid messages are still rejected.
+func TestUnmarshalJSONLenient(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	m := arbor.ProtocolMessage{}
+	g.Expect(json.Unmarshal([]byte(newWithExtras), &m)).To(gomega.Succeed())
+	g.Expect(m.Extra).To(gomega.BeNil())
+	g.Expect(m.IsValidNew()).To(gomega.BeTrue())
+	g.Expect(m.Username).To(gomega.Equal("user"))
+
+	g.Expect(json.Unmarshal([]byte(newWithMeta), &m)).To(gomega.Succeed())
+	var validationErr *arbor.ValidationError
+	g.Expect(errors.As(m.Validate(), &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Field).To(gomega.Equal("Meta"))
+	g.Expect(validationErr.Problem).To(gomega.Equal(arbor.FieldUnexpected))
+
+	reader, err := arbor.NewProtocolReader(bytes.NewBufferString(newWithMeta))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(errors.As(reader.Read(new(arbor.ProtocolMessage)), &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Field).To(gomega.Equal("Meta"))
+}
+
+// TestUnmarshalReused ensures that decoding into a message that was used before
+// leaves nothing behind from its previous contents.
+func TestUnmarshalReused(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	m := arbor.ProtocolMessage{}
+	g.Expect(arbor.UnmarshalProtocolMessage([]byte(newWithExtras), &m, arbor.DecodePreserve)).To(gomega.Succeed())
+	g.Expect(m.Extra).ToNot(gomega.BeEmpty())
+	g.Expect(json.Unmarshal([]byte(`{"Type":0,"Root":"root","Recent":["a"],"Major":1}`), &m)).To(gomega.Succeed())
+	g.Expect(m.Extra).To(gomega.BeNil())
+
+	g.Expect(arbor.UnmarshalProtocolMessage([]byte(newWithExtras), &m, arbor.DecodeLenient)).To(gomega.Succeed())
+	g.Expect(m.Recent).To(gomega.BeNil())
+	g.Expect(m.Major).To(gomega.BeZero())
+	g.Expect(m.Extra).To(gomega.BeNil())
+	g.Expect(m.IsValidNew()).To(gomega.BeTrue())
+}
+
+// TestUnmarshalRoundTrip ensures that decoding reverses MarshalJSON for every
+// message type.
+func TestUnmarshalRoundTrip(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, original := range []*arbor.ProtocolMessage{getWelcome(), getNew(), getQuery(), getMeta()} {
+		for _, mode := range []arbor.DecodeMode{arbor.DecodeLenient, arbor.DecodeStrict, arbor.DecodePreserve} {
+			decoded := &arbor.ProtocolMessage{}
+			g.Expect(arbor.UnmarshalProtocolMessage([]byte(marshalOrFail(t, original)), decoded, mode)).To(gomega.Succeed())
+			g.Expect(decoded.Equals(original)).To(gomega.BeTrue(), "expected %v, got %v", original, decoded)
+		}
+	}
+}
+
+// TestUnmarshalStrict ensures that strict decoding rejects fields that do not belong
+// to the message's type.
+func TestUnmarshalStrict(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, input := range []string{
+		`{"Type":2,"UUID":"id","Content":"hi","Username":"user","Timestamp":1,"Recent":[]}`,
+		`{"Type":1,"UUID":"id","Content":"hi"}`,
+		`{"Type":3,"Meta":{},"Unknown":true}`,
+	} {
+		err := arbor.UnmarshalProtocolMessage([]byte(input), new(arbor.ProtocolMessage), arbor.DecodeStrict)
+		var validationErr *arbor.ValidationError
+		g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue(), input)
+		g.Expect(validationErr.Problem).To(gomega.Equal(arbor.FieldUnexpected))
+	}
+	// field names match without regard to case, like encoding/json
+	g.Expect(arbor.UnmarshalProtocolMessage([]byte(`{"type":1,"uuid":"id"}`), new(arbor.ProtocolMessage), arbor.DecodeStrict)).To(gomega.Succeed())
+}
+
+// TestUnmarshalPreserve ensures that unknown fields can be kept and forwarded.
+func TestUnmarshalPreserve(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	m := &arbor.ProtocolMessage{}
+	g.Expect(arbor.UnmarshalProtocolMessage([]byte(newWithExtras), m, arbor.DecodePreserve)).To(gomega.Succeed())
+	g.Expect(m.Extra).To(gomega.HaveKey("Future"))
+	g.Expect(m.Extra).ToNot(gomega.HaveKey("Root"))
+	g.Expect(marshalOrFail(t, m)).To(gomega.MatchJSON(`{"Type":2,"UUID":"id","Parent":"parent","Content":"hi","Username":"user","Timestamp":1,"Future":{"a":1}}`))
+}
+
+// TestReaderStrict ensures that readers can be configured to decode strictly.
+func TestReaderStrict(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	lenient, err := arbor.NewProtocolReader(bytes.NewBufferString(newWithExtras))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(lenient.Read(new(arbor.ProtocolMessage))).To(gomega.Succeed())
+	strict, err := arbor.NewProtocolReader(bytes.NewBufferString(newWithExtras), arbor.WithDecodeMode(arbor.DecodeStrict))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(strict.Read(new(arbor.ProtocolMessage))).ToNot(gomega.Succeed())
+}
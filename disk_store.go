@@ -0,0 +1,271 @@
+package arbor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SyncPolicy controls how often a DiskStore flushes its log to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes the log to stable storage after every message is written.
+	// This is the safest and slowest policy.
+	SyncAlways SyncPolicy = iota
+	// SyncNever leaves flushing the log to the operating system. Messages added
+	// shortly before a power failure may be lost. Call Sync to flush manually.
+	SyncNever
+)
+
+// diskRecord is a single line within a DiskStore's log file.
+type diskRecord struct {
+	Add    *ChatMessage     `json:",omitempty"`
+	Delete string           `json:",omitempty"`
+	Apply  *ProtocolMessage `json:",omitempty"`
+}
+
+// ensure that DiskStore fulfills the TreeStore interface at compile-time
+var _ TreeStore = &DiskStore{}
+
+// DiskStore is a Store that persists every message that it is given to an
+// append-only log file so that its contents survive restarts. The log holds
+// one JSON record per line. When a DiskStore is opened, the log is replayed
+// to rebuild the in-memory index. A torn record at the end of the log (left
+// by a crash in the middle of a write) is truncated away. DiskStore is safe
+// for concurrent use.
+//
+// The Add method cannot report errors. If writing to the log fails, the
+// message is still available in memory and the error is retained. Check it
+// with Err, Sync, or Close. Messages added after Close are dropped.
+type DiskStore struct {
+	sync.Mutex
+	mem    *Store
+	file   *os.File
+	policy SyncPolicy
+	err    error
+}
+
+// OpenDiskStore opens the log file at path, creating it if necessary, and
+// returns a DiskStore that holds its contents.
+func OpenDiskStore(path string, policy SyncPolicy) (*DiskStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open store log %s", path)
+	}
+	d := &DiskStore{
+		mem:    NewStore(),
+		file:   file,
+		policy: policy,
+	}
+	if err := d.replay(); err != nil {
+		_ = d.mem.Close()
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "Unable to load store log %s", path)
+	}
+	return d, nil
+}
+
+// replay reads the log from the beginning and loads every record into memory.
+// If the final record is incomplete or unreadable, the log is truncated just
+// before it.
+func (d *DiskStore) replay() error {
+	if _, err := d.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(d.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// the last write never finished
+				return d.file.Truncate(offset)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		record := diskRecord{}
+		if decodeErr := json.Unmarshal(bytes.TrimSpace(line), &record); decodeErr != nil || (record.Add == nil && record.Delete == "" && record.Apply == nil) {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				// a garbled final record is the remains of an interrupted write
+				return d.file.Truncate(offset)
+			}
+			return errors.Errorf("Corrupt record at offset %d", offset)
+		}
+		switch {
+		case record.Add != nil:
+			d.mem.Add(record.Add)
+		case record.Apply != nil:
+			if err := d.mem.Apply(record.Apply); err != nil {
+				return errors.Wrapf(err, "Unable to apply record at offset %d", offset)
+			}
+		default:
+			d.mem.Delete(record.Delete)
+		}
+		offset += int64(len(line))
+	}
+}
+
+// append writes the record to the end of the log, honoring the sync policy.
+// The caller must hold the lock.
+func (d *DiskStore) append(record *diskRecord) error {
+	if d.err != nil {
+		return d.err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to encode record")
+	}
+	if _, err := d.file.Write(append(data, '\n')); err != nil {
+		d.err = errors.Wrapf(err, "Unable to write record")
+		return d.err
+	}
+	if d.policy == SyncAlways {
+		if err := d.file.Sync(); err != nil {
+			d.err = errors.Wrapf(err, "Unable to sync log")
+			return d.err
+		}
+	}
+	return nil
+}
+
+// Get retrieves the message with a UUID from the store.
+func (d *DiskStore) Get(uuid string) *ChatMessage {
+	return d.mem.Get(uuid)
+}
+
+// Add writes the given message to the log and inserts it into the store.
+func (d *DiskStore) Add(msg *ChatMessage) {
+	d.Lock()
+	defer d.Unlock()
+	_ = d.append(&diskRecord{Add: msg})
+	d.mem.Add(msg)
+}
+
+// Has reports whether a message with the given UUID is in the store.
+func (d *DiskStore) Has(uuid string) bool {
+	return d.mem.Has(uuid)
+}
+
+// Delete records the removal of the message with the given UUID in the log
+// and removes it from the store. Deleting a message that is not present
+// writes nothing.
+func (d *DiskStore) Delete(uuid string) {
+	d.Lock()
+	defer d.Unlock()
+	if !d.mem.Has(uuid) {
+		return
+	}
+	_ = d.append(&diskRecord{Delete: uuid})
+	d.mem.Delete(uuid)
+}
+
+// Apply updates the store according to a NEW, EDIT, or DELETE message. See
+// Store.Apply. Messages are recorded in the log only if they change the
+// store.
+func (d *DiskStore) Apply(m *ProtocolMessage) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	duplicate := m.Type == NewMessageType && d.mem.Has(m.UUID)
+	if err := d.mem.Apply(m); err != nil {
+		return err
+	}
+	switch {
+	case duplicate:
+		return nil
+	case m.Type == NewMessageType:
+		return d.append(&diskRecord{Add: m.ChatMessage})
+	}
+	return d.append(&diskRecord{Apply: m})
+}
+
+// History returns the previous versions of the message with the given UUID.
+// See Store.History.
+func (d *DiskStore) History(uuid string) []*ChatMessage {
+	return d.mem.History(uuid)
+}
+
+// IsDeleted reports whether the message with the given UUID has been deleted
+// with a DELETE message.
+func (d *DiskStore) IsDeleted(uuid string) bool {
+	return d.mem.IsDeleted(uuid)
+}
+
+// Range calls f for each message in the store until f returns false. See
+// Store.Range.
+func (d *DiskStore) Range(f func(*ChatMessage) bool) {
+	d.mem.Range(f)
+}
+
+// Children returns the messages in the store whose Parent is the given id.
+// See Store.Children.
+func (d *DiskStore) Children(id string) []*ChatMessage {
+	return d.mem.Children(id)
+}
+
+// Ancestors returns the chain of messages above the message with the given id.
+// See Store.Ancestors.
+func (d *DiskStore) Ancestors(id string) []*ChatMessage {
+	return d.mem.Ancestors(id)
+}
+
+// Subtree returns the message with the given id and its descendants. See
+// Store.Subtree.
+func (d *DiskStore) Subtree(id string, depth int) []*ChatMessage {
+	return d.mem.Subtree(id, depth)
+}
+
+// Leaves returns every message in the store that has no replies in the store.
+// See Store.Leaves.
+func (d *DiskStore) Leaves() []*ChatMessage {
+	return d.mem.Leaves()
+}
+
+// Err returns the first error encountered while writing to the log, if any.
+// Once an error has occurred, no further records are written.
+func (d *DiskStore) Err() error {
+	d.Lock()
+	defer d.Unlock()
+	return d.err
+}
+
+// Sync flushes the log to stable storage.
+func (d *DiskStore) Sync() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	if err := d.file.Sync(); err != nil {
+		d.err = errors.Wrapf(err, "Unable to sync log")
+	}
+	return d.err
+}
+
+// Close flushes and closes the log file and stops the in-memory index. It
+// returns the first error encountered while writing to the log, if any.
+func (d *DiskStore) Close() error {
+	d.Lock()
+	defer d.Unlock()
+	if err := d.mem.Close(); err != nil {
+		return err
+	}
+	err := d.err
+	if err == nil {
+		err = d.file.Sync()
+	}
+	if closeErr := d.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,177 @@
+package arbor_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/arbor-go/storetest"
+	"github.com/onsi/gomega"
+)
+
+// tempLog returns the path of a log file inside a fresh temporary directory, along
+// with a function that removes the directory.
+func tempLog(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "arbor-disk-store")
+	if err != nil {
+		t.Skip("Unable to create temporary directory", err)
+	}
+	return filepath.Join(dir, "store.log"), func() { _ = os.RemoveAll(dir) }
+}
+
+// TestDiskStoreConformance runs the shared MessageStore test suite against DiskStore.
+func TestDiskStoreConformance(t *testing.T) {
+	path, cleanup := tempLog(t)
+	defer cleanup()
+	count := 0
+	storetest.Run(t, func(t *testing.T) arbor.MessageStore {
+		count++
+		return openOrFail(t, path+strconv.Itoa(count))
+	})
+}
+
+// TestDiskStoreDeletePersists ensures that deletions survive reopening the store.
+func TestDiskStoreDeletePersists(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	path, cleanup := tempLog(t)
+	defer cleanup()
+	d := openOrFail(t, path)
+	kept, deleted := randomMessage(), randomMessage()
+	d.Add(kept)
+	d.Add(deleted)
+	d.Delete(deleted.UUID)
+	g.Expect(d.Close()).To(gomega.Succeed())
+
+	d = openOrFail(t, path)
+	defer d.Close()
+	g.Expect(d.Has(kept.UUID)).To(gomega.BeTrue())
+	g.Expect(d.Has(deleted.UUID)).To(gomega.BeFalse())
+}
+
+func openOrFail(t *testing.T, path string) *arbor.DiskStore {
+	d, err := arbor.OpenDiskStore(path, arbor.SyncAlways)
+	if err != nil {
+		t.Fatal("Unable to open disk store", err)
+	}
+	return d
+}
+
+// TestDiskStorePersists ensures that messages added to a DiskStore are present after
+// it is closed and reopened.
+func TestDiskStorePersists(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	path, cleanup := tempLog(t)
+	defer cleanup()
+	d := openOrFail(t, path)
+	msgs := make([]*arbor.ChatMessage, 100)
+	for i := range msgs {
+		msgs[i] = randomMessage()
+		d.Add(msgs[i])
+	}
+	g.Expect(d.Close()).To(gomega.Succeed())
+
+	d = openOrFail(t, path)
+	defer d.Close()
+	for _, msg := range msgs {
+		g.Expect(d.Get(msg.UUID).Equals(msg)).To(gomega.BeTrue())
+	}
+	g.Expect(d.Get(nonexsitentID)).To(gomega.BeNil())
+}
+
+// TestDiskStoreTornRecord ensures that an incomplete record at the end of the log is
+// discarded when the store is opened and that writing can resume afterward.
+func TestDiskStoreTornRecord(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	path, cleanup := tempLog(t)
+	defer cleanup()
+	d := openOrFail(t, path)
+	first := randomMessage()
+	d.Add(first)
+	g.Expect(d.Close()).To(gomega.Succeed())
+
+	for _, torn := range []string{`{"Add":{"UUID":"tor`, "{garbage}\n"} {
+		before, err := ioutil.ReadFile(path)
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		g.Expect(ioutil.WriteFile(path, append(before, torn...), 0600)).To(gomega.Succeed())
+
+		d = openOrFail(t, path)
+		g.Expect(d.Get(first.UUID).Equals(first)).To(gomega.BeTrue())
+		second := randomMessage()
+		d.Add(second)
+		g.Expect(d.Close()).To(gomega.Succeed())
+
+		d = openOrFail(t, path)
+		g.Expect(d.Get(second.UUID).Equals(second)).To(gomega.BeTrue())
+		g.Expect(d.Close()).To(gomega.Succeed())
+	}
+}
+
+// TestDiskStoreCorrupt ensures that damage in the middle of the log is reported rather
+// than silently discarding the records after it.
+func TestDiskStoreCorrupt(t *testing.T) {
+	path, cleanup := tempLog(t)
+	defer cleanup()
+	d := openOrFail(t, path)
+	d.Add(randomMessage())
+	if err := d.Close(); err != nil {
+		t.Skip("Unable to write test data", err)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Skip("Unable to read test data", err)
+	}
+	contents = append([]byte("{garbage}\n"), contents...)
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Skip("Unable to write test data", err)
+	}
+	if _, err := arbor.OpenDiskStore(path, arbor.SyncAlways); err == nil {
+		t.Error("Expected error opening log with a corrupt record in the middle")
+	}
+}
+
+// TestDiskStoreWriteError ensures that write failures are retained and reported, and
+// that the message is still available in memory.
+func TestDiskStoreWriteError(t *testing.T) {
+	path, cleanup := tempLog(t)
+	defer cleanup()
+	d := openOrFail(t, path)
+	if err := d.CloseLog(); err != nil {
+		t.Skip("Unable to close log", err)
+	}
+	msg := randomMessage()
+	d.Add(msg)
+	if d.Err() == nil {
+		t.Error("Expected error after failing to write to the log")
+	}
+	if d.Get(msg.UUID) == nil {
+		t.Error("Message should still be available in memory after a write error")
+	}
+	if err := d.Close(); err == nil {
+		t.Error("Expected Close to report the write error")
+	}
+}
+
+// TestDiskStoreAddAfterClose ensures that messages added after Close are dropped
+// and the failure is reported.
+func TestDiskStoreAddAfterClose(t *testing.T) {
+	path, cleanup := tempLog(t)
+	defer cleanup()
+	d := openOrFail(t, path)
+	if err := d.Close(); err != nil {
+		t.Skip("Unable to close store", err)
+	}
+	msg := randomMessage()
+	d.Add(msg)
+	if d.Err() == nil {
+		t.Error("Expected error after adding to a closed DiskStore")
+	}
+	if d.Get(msg.UUID) != nil {
+		t.Error("Message added after Close should be dropped")
+	}
+	if err := d.Close(); err == nil {
+		t.Error("Expected error closing a DiskStore twice")
+	}
+}
@@ -0,0 +1,177 @@
+package arbor
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// TombstoneContent replaces the Content of messages that have been deleted.
+const TombstoneContent = "[deleted]"
+
+var (
+	// ErrMessageNotFound is returned when an EDIT or DELETE targets a message
+	// that is not in the Store.
+	ErrMessageNotFound = errors.New("Target message not found")
+	// ErrNotAuthor is returned when an EDIT or DELETE is sent by someone other
+	// than the author of the target message.
+	ErrNotAuthor = errors.New("Only the author of a message may change it")
+	// ErrMessageDeleted is returned when an EDIT targets a deleted message.
+	ErrMessageDeleted = errors.New("Target message has been deleted")
+	// ErrMessageExists is returned when a NEW message has the UUID of a
+	// different message that is already in the Store.
+	ErrMessageExists = errors.New("A different message with the same UUID already exists")
+)
+
+// Apply updates the store according to a NEW, EDIT, or DELETE message.
+//
+// NEW messages are added to the store. A NEW message that is already in the
+// store, either as it is now or as one of its previous versions, is ignored.
+// EDIT messages replace the Content of
+// their target, and the previous version is kept in the target's History.
+// DELETE messages replace their target with a tombstone: a copy whose Content
+// is TombstoneContent, so that replies to the target remain connected to the
+// tree. Deleting a message also discards its History. The tombstone remains
+// in place if the original message is added again later. Subscribers receive
+// the edited message or the tombstone.
+//
+// Apply returns ErrMessageNotFound if the target is not in the store and
+// ErrNotAuthor if the Username of an EDIT or DELETE does not match its target.
+// A NEW message cannot replace a different message with the same UUID. Apply
+// returns ErrNotAuthor if their Usernames differ, ErrMessageDeleted if the
+// stored message has been deleted, and ErrMessageExists otherwise.
+func (s *Store) Apply(m *ProtocolMessage) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	var err error
+	switch m.Type {
+	case NewMessageType:
+		if doErr := s.doContext(context.Background(), func() {
+			err = s.create(m)
+		}); doErr != nil {
+			return doErr
+		}
+	case EditType:
+		if doErr := s.doContext(context.Background(), func() {
+			err = s.edit(m)
+		}); doErr != nil {
+			return doErr
+		}
+	case DeleteType:
+		if doErr := s.doContext(context.Background(), func() {
+			err = s.retract(m)
+		}); doErr != nil {
+			return doErr
+		}
+	default:
+		return errors.Errorf("Cannot apply %s message to store", typeName(m.Type))
+	}
+	return err
+}
+
+// create implements Apply for NEW messages. It must only be called from the
+// dispatch goroutine.
+func (s *Store) create(m *ProtocolMessage) error {
+	existing, ok := s.m[m.UUID]
+	if !ok {
+		s.insert(m.ChatMessage)
+		return nil
+	}
+	_, deleted := s.deleted[m.UUID]
+	switch {
+	case existing.Username != m.Username:
+		return ErrNotAuthor
+	case deleted:
+		return ErrMessageDeleted
+	case existing.Equals(m.ChatMessage):
+		return nil
+	}
+	for _, previous := range s.history[m.UUID] {
+		if previous.Equals(m.ChatMessage) {
+			return nil
+		}
+	}
+	return ErrMessageExists
+}
+
+// authorize checks that the target of m exists and was written by the sender
+// of m. It must only be called from the dispatch goroutine.
+func (s *Store) authorize(m *ProtocolMessage) (*ChatMessage, error) {
+	target, ok := s.m[m.Target]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	if target.Username != m.Username {
+		return nil, ErrNotAuthor
+	}
+	return target, nil
+}
+
+// edit implements Apply for EDIT messages. It must only be called from the
+// dispatch goroutine.
+func (s *Store) edit(m *ProtocolMessage) error {
+	target, err := s.authorize(m)
+	if err != nil {
+		return err
+	}
+	if _, deleted := s.deleted[target.UUID]; deleted {
+		return ErrMessageDeleted
+	}
+	edited := *target
+	edited.Content = m.Content
+	s.history[target.UUID] = append(s.history[target.UUID], target)
+	s.replace(&edited)
+	return nil
+}
+
+// retract implements Apply for DELETE messages. It must only be called from
+// the dispatch goroutine.
+func (s *Store) retract(m *ProtocolMessage) error {
+	target, err := s.authorize(m)
+	if err != nil {
+		return err
+	}
+	s.deleted[target.UUID] = struct{}{}
+	delete(s.history, target.UUID)
+	s.replace(tombstone(target))
+	return nil
+}
+
+// tombstone returns a copy of msg with its Content removed.
+func tombstone(msg *ChatMessage) *ChatMessage {
+	dead := *msg
+	dead.Content = TombstoneContent
+	return &dead
+}
+
+// replace swaps a stored message for a new version with the same UUID and
+// Parent without otherwise disturbing the store, and delivers the new version
+// to subscribers. It must only be called from the dispatch goroutine.
+func (s *Store) replace(msg *ChatMessage) {
+	s.unindex(s.m[msg.UUID])
+	s.m[msg.UUID] = msg
+	s.index(msg)
+	s.notify(msg)
+}
+
+// History returns the previous versions of the message with the given UUID,
+// oldest first. It is empty if the message has never been edited or has been
+// deleted.
+func (s *Store) History(uuid string) []*ChatMessage {
+	history := []*ChatMessage{}
+	s.do(func() {
+		history = append(history, s.history[uuid]...)
+	})
+	return history
+}
+
+// IsDeleted reports whether the message with the given UUID has been deleted
+// with a DELETE message.
+func (s *Store) IsDeleted(uuid string) bool {
+	var deleted bool
+	s.do(func() {
+		_, deleted = s.deleted[uuid]
+	})
+	return deleted
+}
@@ -0,0 +1,183 @@
+package arbor_test
+
+import (
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// TestEditDeleteMessages ensures that EDIT and DELETE messages validate and marshal
+// only their own fields.
+func TestEditDeleteMessages(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	edit := arbor.NewEdit(testID1, testUser, testContent)
+	g.Expect(edit.Validate()).To(gomega.Succeed())
+	strEdit := marshalOrFail(t, edit)
+	g.Expect(contains(strEdit, append(welcomeOnlyFields, "Parent", "UUID", "Meta"), []string{"Type", "Target", "Username", "Content", "Timestamp"})).To(gomega.BeFalse(), strEdit)
+
+	del := arbor.NewDelete(testID1, testUser)
+	g.Expect(del.Validate()).To(gomega.Succeed())
+	strDelete := marshalOrFail(t, del)
+	g.Expect(contains(strDelete, append(welcomeOnlyFields, "Parent", "UUID", "Content", "Meta"), []string{"Type", "Target", "Username", "Timestamp"})).To(gomega.BeFalse(), strDelete)
+
+	for _, m := range []*arbor.ProtocolMessage{edit, del} {
+		decoded := &arbor.ProtocolMessage{}
+		g.Expect(arbor.UnmarshalProtocolMessage([]byte(marshalOrFail(t, m)), decoded, arbor.DecodeStrict)).To(gomega.Succeed())
+		g.Expect(decoded.Equals(m)).To(gomega.BeTrue())
+	}
+
+	edit.Target = ""
+	g.Expect(edit.IsValid()).To(gomega.BeFalse())
+	edit = arbor.NewEdit(testID1, testUser, "")
+	g.Expect(edit.IsValid()).To(gomega.BeFalse())
+	del.Content = testContent
+	g.Expect(del.IsValid()).To(gomega.BeFalse())
+}
+
+// TestStoreApplyEdit ensures that edits by the author replace a message's content and
+// keep its previous versions.
+func TestStoreApplyEdit(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	original := getNew()
+	g.Expect(s.Apply(original)).To(gomega.Succeed())
+	g.Expect(s.Apply(arbor.NewEdit(original.UUID, testUser, "first edit"))).To(gomega.Succeed())
+	g.Expect(s.Apply(arbor.NewEdit(original.UUID, testUser, "second edit"))).To(gomega.Succeed())
+
+	current := s.Get(original.UUID)
+	g.Expect(current.Content).To(gomega.Equal("second edit"))
+	g.Expect(current.Parent).To(gomega.Equal(original.Parent))
+	g.Expect(current.Timestamp).To(gomega.Equal(original.Timestamp))
+	history := s.History(original.UUID)
+	g.Expect(history).To(gomega.HaveLen(2))
+	g.Expect(history[0].Equals(original.ChatMessage)).To(gomega.BeTrue())
+	g.Expect(history[1].Content).To(gomega.Equal("first edit"))
+	g.Expect(ids(s.Search(arbor.SearchQuery{Text: "second"}))).To(gomega.Equal([]string{original.UUID}))
+
+	g.Expect(s.Apply(arbor.NewEdit(original.UUID, "impostor", "pwned"))).To(gomega.Equal(arbor.ErrNotAuthor))
+	g.Expect(s.Apply(arbor.NewEdit(nonexsitentID, testUser, "hi"))).To(gomega.Equal(arbor.ErrMessageNotFound))
+	g.Expect(s.Apply(getWelcome())).ToNot(gomega.Succeed())
+	g.Expect(s.Apply(arbor.NewEdit(original.UUID, testUser, ""))).ToNot(gomega.Succeed())
+}
+
+// TestStoreApplyDelete ensures that deleted messages become tombstones that keep the
+// tree intact.
+func TestStoreApplyDelete(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	tree := buildTree(s)
+	for _, msg := range tree {
+		msg.Username = testUser
+	}
+	g.Expect(s.Apply(arbor.NewDelete("a", "impostor"))).To(gomega.Equal(arbor.ErrNotAuthor))
+	g.Expect(s.IsDeleted("a")).To(gomega.BeFalse())
+	g.Expect(s.Apply(arbor.NewEdit("a", testUser, "edited"))).To(gomega.Succeed())
+	g.Expect(s.Apply(arbor.NewDelete("a", testUser))).To(gomega.Succeed())
+
+	g.Expect(s.IsDeleted("a")).To(gomega.BeTrue())
+	g.Expect(s.Get("a").Content).To(gomega.Equal(arbor.TombstoneContent))
+	g.Expect(s.History("a")).To(gomega.BeEmpty())
+	g.Expect(ids(s.Children("a"))).To(gomega.Equal([]string{"c", "d"}))
+	g.Expect(ids(s.Ancestors("c"))).To(gomega.Equal([]string{"a", "root"}))
+	g.Expect(s.Apply(arbor.NewEdit("a", testUser, "resurrected"))).To(gomega.Equal(arbor.ErrMessageDeleted))
+
+	// receiving the original again must not undo the deletion
+	s.Add(tree["a"])
+	g.Expect(s.Get("a").Content).To(gomega.Equal(arbor.TombstoneContent))
+}
+
+// TestStoreApplyNotifies ensures that subscribers receive edited messages and
+// tombstones.
+func TestStoreApplyNotifies(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	original := getNew()
+	s.Add(original.ChatMessage)
+	sub := subscribeOrFail(t, s, arbor.SubscriptionFilter{})
+	defer sub.Unsubscribe()
+	g.Expect(s.Apply(arbor.NewEdit(original.UUID, testUser, "edited"))).To(gomega.Succeed())
+	g.Expect(s.Apply(arbor.NewDelete(original.UUID, testUser))).To(gomega.Succeed())
+	for _, content := range []string{"edited", arbor.TombstoneContent} {
+		var received *arbor.ChatMessage
+		g.Eventually(sub.C).Should(gomega.Receive(&received))
+		g.Expect(received.UUID).To(gomega.Equal(original.UUID))
+		g.Expect(received.Content).To(gomega.Equal(content))
+	}
+}
+
+// TestDiskStoreApplyPersists ensures that edits and deletions survive reopening a
+// DiskStore.
+func TestDiskStoreApplyPersists(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	path, cleanup := tempLog(t)
+	defer cleanup()
+	d := openOrFail(t, path)
+	edited, deleted := getNew(), getNew()
+	deleted.UUID = "deleted"
+	g.Expect(d.Apply(edited)).To(gomega.Succeed())
+	g.Expect(d.Apply(deleted)).To(gomega.Succeed())
+	g.Expect(d.Apply(arbor.NewEdit(edited.UUID, testUser, "edited"))).To(gomega.Succeed())
+	g.Expect(d.Apply(arbor.NewDelete(deleted.UUID, testUser))).To(gomega.Succeed())
+	g.Expect(d.Apply(arbor.NewEdit(deleted.UUID, "impostor", "pwned"))).To(gomega.Equal(arbor.ErrNotAuthor))
+	g.Expect(d.Close()).To(gomega.Succeed())
+
+	d = openOrFail(t, path)
+	defer d.Close()
+	g.Expect(d.Get(edited.UUID).Content).To(gomega.Equal("edited"))
+	g.Expect(d.History(edited.UUID)).To(gomega.HaveLen(1))
+	g.Expect(d.IsDeleted(deleted.UUID)).To(gomega.BeTrue())
+	g.Expect(d.Get(deleted.UUID).Content).To(gomega.Equal(arbor.TombstoneContent))
+}
+
+// TestStoreApplyNewExisting ensures that NEW messages cannot replace a different
+// message with the same UUID, while repeated deliveries are harmless.
+func TestStoreApplyNewExisting(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	original := getNew()
+	g.Expect(s.Apply(original)).To(gomega.Succeed())
+	g.Expect(s.Apply(arbor.NewEdit(original.UUID, testUser, "edited"))).To(gomega.Succeed())
+
+	// the original and the current version may both be delivered again
+	g.Expect(s.Apply(original)).To(gomega.Succeed())
+	current := &arbor.ProtocolMessage{Type: arbor.NewMessageType, ChatMessage: s.Get(original.UUID)}
+	g.Expect(s.Apply(current)).To(gomega.Succeed())
+	g.Expect(s.History(original.UUID)).To(gomega.HaveLen(1))
+
+	forged := getNew()
+	forged.Username, forged.Content = "impostor", "pwned"
+	g.Expect(s.Apply(forged)).To(gomega.Equal(arbor.ErrNotAuthor))
+	rewritten := getNew()
+	rewritten.Content = "rewritten"
+	g.Expect(s.Apply(rewritten)).To(gomega.Equal(arbor.ErrMessageExists))
+	g.Expect(s.Get(original.UUID).Content).To(gomega.Equal("edited"))
+
+	g.Expect(s.Apply(arbor.NewDelete(original.UUID, testUser))).To(gomega.Succeed())
+	g.Expect(s.Apply(original)).To(gomega.Equal(arbor.ErrMessageDeleted))
+	g.Expect(s.Get(original.UUID).Content).To(gomega.Equal(arbor.TombstoneContent))
+}
+
+// TestDiskStoreApplyNewExisting ensures that a DiskStore neither applies nor logs NEW
+// messages that would replace a different message.
+func TestDiskStoreApplyNewExisting(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	path, cleanup := tempLog(t)
+	defer cleanup()
+	d := openOrFail(t, path)
+	original := getNew()
+	g.Expect(d.Apply(original)).To(gomega.Succeed())
+	g.Expect(d.Apply(original)).To(gomega.Succeed())
+	forged := getNew()
+	forged.Username, forged.Content = "impostor", "pwned"
+	g.Expect(d.Apply(forged)).To(gomega.Equal(arbor.ErrNotAuthor))
+	g.Expect(d.Close()).To(gomega.Succeed())
+
+	d = openOrFail(t, path)
+	defer d.Close()
+	g.Expect(d.Get(original.UUID).Equals(original.ChatMessage)).To(gomega.BeTrue())
+}
@@ -0,0 +1,107 @@
+package arbor
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Standard values for the Code field of ERROR messages. Applications may
+// define their own codes as well.
+const (
+	// CodeInvalidMessage means that the rejected message failed validation.
+	CodeInvalidMessage = "invalid-message"
+	// CodeUnknownType means that the rejected message has a Type that the
+	// sender does not understand.
+	CodeUnknownType = "unknown-type"
+	// CodeTooLarge means that the rejected message exceeds a size limit.
+	CodeTooLarge = "too-large"
+	// CodeRateLimited means that the peer is sending messages too quickly.
+	CodeRateLimited = "rate-limited"
+	// CodeNotFound means that a message referenced by the rejected message
+	// could not be found.
+	CodeNotFound = "not-found"
+	// CodeNotAuthor means that the rejected EDIT or DELETE was not sent by the
+	// author of its target.
+	CodeNotAuthor = "not-author"
+	// CodeDeleted means that the rejected message refers to a deleted message.
+	CodeDeleted = "deleted"
+	// CodeUnsupportedVersion means that the peer's protocol version is not
+	// supported.
+	CodeUnsupportedVersion = "unsupported-version"
+	// CodeInternal means that the sender failed for reasons of its own.
+	CodeInternal = "internal"
+)
+
+// NewError creates an ERROR message with the given code and human-readable
+// text. If the error concerns a particular message, target should be its
+// UUID. Otherwise target may be empty.
+func NewError(code, text, target string) *ProtocolMessage {
+	return &ProtocolMessage{
+		Type:   ErrorType,
+		Code:   code,
+		Text:   text,
+		Target: target,
+	}
+}
+
+// NewRejection creates an ERROR message explaining why the message with UUID
+// target was refused because of err. Errors produced by this package are
+// given the matching standard code. Any other error is reported as
+// CodeInternal without revealing its text.
+func NewRejection(err error, target string) *ProtocolMessage {
+	var (
+		validationErr *ValidationError
+		versionErr    *VersionError
+		limitErr      *LimitError
+	)
+	switch {
+	case errors.As(err, &limitErr):
+		return NewError(CodeTooLarge, limitErr.Error(), target)
+	case errors.As(err, &validationErr) && validationErr.Problem == UnknownType:
+		return NewError(CodeUnknownType, validationErr.Error(), target)
+	case errors.As(err, &validationErr):
+		return NewError(CodeInvalidMessage, validationErr.Error(), target)
+	case errors.As(err, &versionErr):
+		return NewError(CodeUnsupportedVersion, versionErr.Error(), target)
+	case errors.Is(err, ErrMessageNotFound):
+		return NewError(CodeNotFound, err.Error(), target)
+	case errors.Is(err, ErrNotAuthor):
+		return NewError(CodeNotAuthor, err.Error(), target)
+	case errors.Is(err, ErrMessageDeleted):
+		return NewError(CodeDeleted, err.Error(), target)
+	case errors.Is(err, ErrMessageExists):
+		return NewError(CodeInvalidMessage, err.Error(), target)
+	}
+	return NewError(CodeInternal, "Internal error", target)
+}
+
+// RemoteError is an error reported by a peer in an ERROR message.
+type RemoteError struct {
+	// Code is the machine-readable description of the problem.
+	Code string
+	// Text is the human-readable description of the problem, if any.
+	Text string
+	// Target is the UUID of the message that the error concerns, if any.
+	Target string
+}
+
+// Error describes the problem reported by the peer.
+func (e *RemoteError) Error() string {
+	description := e.Code
+	if e.Text != "" {
+		description = fmt.Sprintf("%s (%s)", e.Text, e.Code)
+	}
+	if e.Target == "" {
+		return fmt.Sprintf("Peer reported error: %s", description)
+	}
+	return fmt.Sprintf("Peer reported error with message %s: %s", e.Target, description)
+}
+
+// Err returns the error described by an ERROR message as a *RemoteError. It
+// returns nil for messages of any other type.
+func (m *ProtocolMessage) Err() error {
+	if m.Type != ErrorType {
+		return nil
+	}
+	return &RemoteError{Code: m.Code, Text: m.Text, Target: m.Target}
+}
@@ -0,0 +1,58 @@
+package arbor_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// TestErrorMessage ensures that ERROR messages validate, survive serialization, and
+// convert to errors.
+func TestErrorMessage(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, msg := range []*arbor.ProtocolMessage{
+		arbor.NewError(arbor.CodeRateLimited, "Slow down", ""),
+		arbor.NewError(arbor.CodeTooLarge, "", testID1),
+	} {
+		g.Expect(msg.Validate()).To(gomega.Succeed())
+		decoded := &arbor.ProtocolMessage{}
+		g.Expect(arbor.UnmarshalProtocolMessage([]byte(marshalOrFail(t, msg)), decoded, arbor.DecodeStrict)).To(gomega.Succeed())
+		g.Expect(decoded.Equals(msg)).To(gomega.BeTrue(), "expected %v, got %v", msg, decoded)
+
+		var remote *arbor.RemoteError
+		g.Expect(errors.As(decoded.Err(), &remote)).To(gomega.BeTrue())
+		g.Expect(*remote).To(gomega.Equal(arbor.RemoteError{Code: msg.Code, Text: msg.Text, Target: msg.Target}))
+	}
+	g.Expect(arbor.NewError("", "No code", "").IsValid()).To(gomega.BeFalse())
+	g.Expect(getNew().Err()).To(gomega.BeNil())
+}
+
+// TestNewRejection ensures that errors from this package are given their standard
+// codes.
+func TestNewRejection(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	invalid := getNew()
+	invalid.Username = ""
+	unknown := getNew()
+	unknown.Type = 250
+	_, versionErr := arbor.NegotiateVersion(arbor.ProtocolMajor+1, 0)
+	for err, code := range map[error]string{
+		invalid.Validate():         arbor.CodeInvalidMessage,
+		unknown.Validate():         arbor.CodeUnknownType,
+		versionErr:                 arbor.CodeUnsupportedVersion,
+		arbor.ErrMessageNotFound:   arbor.CodeNotFound,
+		arbor.ErrNotAuthor:         arbor.CodeNotAuthor,
+		arbor.ErrMessageDeleted:    arbor.CodeDeleted,
+		arbor.ErrMessageExists:     arbor.CodeInvalidMessage,
+		fmt.Errorf("disk on fire"): arbor.CodeInternal,
+	} {
+		rejection := arbor.NewRejection(err, testID1)
+		g.Expect(rejection.Validate()).To(gomega.Succeed())
+		g.Expect(rejection.Code).To(gomega.Equal(code), "for error %v", err)
+		g.Expect(rejection.Target).To(gomega.Equal(testID1))
+	}
+	g.Expect(arbor.NewRejection(fmt.Errorf("disk on fire"), "").Text).ToNot(gomega.ContainSubstring("disk"))
+}
@@ -0,0 +1,15 @@
+package arbor
+
+// CloseLog closes the log file of a DiskStore without closing the store, so
+// that tests can cause writes to fail.
+func (d *DiskStore) CloseLog() error {
+	return d.file.Close()
+}
+
+// UnregisterType removes a message type added with RegisterType, so that
+// tests can register types without affecting later runs.
+func UnregisterType(messageType uint8) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.types, messageType)
+}
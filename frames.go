@@ -0,0 +1,312 @@
+package arbor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// MetaKeyFraming is the Meta key of a META message that announces a change of
+// framing (see ProtocolWriter.SwitchFraming). Its value is the name of the
+// framing used for everything that the sender writes afterward.
+const MetaKeyFraming = "arbor.framing"
+
+// Framing determines how messages are separated from one another on the wire.
+type Framing int
+
+const (
+	// FramingNewline writes each message as JSON followed by a newline. It is
+	// understood by every peer and is the default.
+	FramingNewline Framing = iota
+	// FramingVarint writes each message as its length in bytes, encoded as an
+	// unsigned varint (see encoding/binary), followed by the message itself.
+	// Readers know the size of a message before reading it. Peers must agree
+	// to use it, usually by advertising it in Capabilities.Framings.
+	FramingVarint
+)
+
+// String returns the name of the framing, as used in META messages.
+func (f Framing) String() string {
+	switch f {
+	case FramingNewline:
+		return "newline"
+	case FramingVarint:
+		return "varint"
+	default:
+		return fmt.Sprintf("Framing(%d)", int(f))
+	}
+}
+
+// ParseFraming returns the framing with the given name.
+func ParseFraming(name string) (Framing, error) {
+	for _, f := range []Framing{FramingNewline, FramingVarint} {
+		if f.String() == name {
+			return f, nil
+		}
+	}
+	return FramingNewline, fmt.Errorf("Unknown framing %q", name)
+}
+
+// WithFraming sets the framing that a reader or writer starts with. Both peers
+// must start with the same framing, so only FramingNewline (the default) is
+// appropriate unless the peers have agreed on another in advance. Otherwise
+// switch framings after connecting with ProtocolWriter.SwitchFraming. Readers
+// follow such switches automatically.
+func WithFraming(framing Framing) Option {
+	return func(o *options) {
+		o.framing = framing
+	}
+}
+
+// WithResync makes a reader recover from malformed input. Normally a message
+// that cannot be decoded leaves the reader unable to continue. In resync
+// mode, every message must be followed by a newline (as written by
+// ProtocolWriter and MakeMessageWriter) unless another Framing is in use.
+// When a frame cannot be decoded into a valid message, it is passed to
+// onBadFrame along with the reason and the reader moves on to the next frame.
+// Bad frames are not returned by Read.
+// onBadFrame may be nil. It is called from the reader's internal goroutine
+// and must not block for long.
+func WithResync(onBadFrame func(frame []byte, err error)) Option {
+	return func(o *options) {
+		o.resync = true
+		o.onBadFrame = onBadFrame
+	}
+}
+
+// frameReader splits a stream into frames that each hold one encoded message.
+type frameReader interface {
+	// next returns the next frame. The frame is only valid until the
+	// following call.
+	next() ([]byte, error)
+	// remainder returns the rest of the stream after the last frame returned.
+	remainder() io.Reader
+}
+
+// newFrameReader creates a frameReader that splits source using framing.
+func newFrameReader(source io.Reader, framing Framing, config options) frameReader {
+	maxSize := config.limits.MaxFrameSize
+	switch {
+	case framing == FramingVarint:
+		return &varintFrames{reader: buffered(source), maxSize: maxSize}
+	case config.resync || maxSize > 0:
+		return &lineFrames{reader: buffered(source), maxSize: maxSize}
+	default:
+		return &jsonFrames{decoder: json.NewDecoder(source), source: source}
+	}
+}
+
+// buffered returns source as a *bufio.Reader, wrapping it only if necessary.
+func buffered(source io.Reader) *bufio.Reader {
+	if reader, ok := source.(*bufio.Reader); ok {
+		return reader
+	}
+	return bufio.NewReader(source)
+}
+
+// encodeFrame encodes the message as a single frame. See encodeMessage for
+// the meaning of passthrough.
+func encodeFrame(msg *ProtocolMessage, framing Framing, codec Codec, passthrough bool) ([]byte, error) {
+	data, err := encodeMessage(msg, codec, passthrough)
+	if err != nil {
+		return nil, err
+	}
+	if framing == FramingVarint {
+		prefix := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+		prefix = prefix[:binary.PutUvarint(prefix, uint64(len(data)))]
+		return append(prefix, data...), nil
+	}
+	return append(data, '\n'), nil
+}
+
+// jsonFrames finds frames by parsing JSON values. It cannot recover from
+// malformed input.
+type jsonFrames struct {
+	decoder *json.Decoder
+	source  io.Reader
+}
+
+func (f *jsonFrames) next() ([]byte, error) {
+	var raw json.RawMessage
+	err := f.decoder.Decode(&raw)
+	return raw, err
+}
+
+func (f *jsonFrames) remainder() io.Reader {
+	rest := bufio.NewReader(io.MultiReader(f.decoder.Buffered(), f.source))
+	// the newline that ends the last frame belongs to it
+	for {
+		b, err := rest.ReadByte()
+		if err != nil || b == '\n' {
+			break
+		}
+		if b != ' ' && b != '\t' && b != '\r' {
+			_ = rest.UnreadByte()
+			break
+		}
+	}
+	return rest
+}
+
+// lineFrames finds frames by splitting on newlines. Blank lines are skipped.
+type lineFrames struct {
+	reader *bufio.Reader
+	// maxSize is the length of the longest frame allowed, if nonzero
+	maxSize int
+}
+
+func (f *lineFrames) next() ([]byte, error) {
+	for {
+		line, err := f.readLine()
+		if err != nil && err != io.EOF {
+			return line, err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			// a final frame without a newline is still a frame
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readLine reads through the next newline. Lines longer than maxSize are
+// skipped, and their beginning is returned along with a *LimitError.
+func (f *lineFrames) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := f.reader.ReadSlice('\n')
+		if f.maxSize > 0 && len(line)+len(chunk) > f.maxSize {
+			size := len(line) + len(chunk)
+			line = append(line, chunk[:f.maxSize-len(line)]...)
+			for err == bufio.ErrBufferFull {
+				chunk, err = f.reader.ReadSlice('\n')
+				size += len(chunk)
+			}
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			return line, &LimitError{Limit: "MaxFrameSize", Max: f.maxSize, Size: size}
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+func (f *lineFrames) remainder() io.Reader {
+	return f.reader
+}
+
+// varintFrames reads frames that are prefixed with their length.
+type varintFrames struct {
+	reader *bufio.Reader
+	// maxSize is the length of the longest frame allowed, if nonzero
+	maxSize int
+	// frame holds the frame most recently read
+	frame bytes.Buffer
+}
+
+func (f *varintFrames) next() ([]byte, error) {
+	size, err := binary.ReadUvarint(f.reader)
+	if err != nil {
+		return nil, err
+	}
+	if size > math.MaxInt32 {
+		return nil, fmt.Errorf("Frame length %d is too large", size)
+	}
+	if f.maxSize > 0 && size > uint64(f.maxSize) {
+		// skip the frame without holding on to it
+		if _, err := io.CopyN(ioutil.Discard, f.reader, int64(size)); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, &LimitError{Limit: "MaxFrameSize", Max: f.maxSize, Size: int(size)}
+	}
+	// the length comes from the peer, so memory is only allocated as the
+	// frame actually arrives
+	f.frame.Reset()
+	if _, err := io.CopyN(&f.frame, f.reader, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f.frame.Bytes(), nil
+}
+
+func (f *varintFrames) remainder() io.Reader {
+	return f.reader
+}
+
+// messageSource decodes messages from the frames of a stream.
+type messageSource struct {
+	frames  frameReader
+	options options
+	// validate causes messages that are not valid to be treated as errors.
+	validate bool
+}
+
+// newMessageSource creates a messageSource that reads from source as
+// configured.
+func newMessageSource(source io.Reader, config options, validate bool) *messageSource {
+	frames := newFrameReader(source, config.framing, config)
+	return &messageSource{frames: frames, options: config, validate: validate}
+}
+
+// next returns the next message in the stream. In resync mode, bad frames
+// are reported and skipped, so the only errors are from the underlying
+// io.Reader. Announcements of a change of framing are followed and are not
+// returned.
+func (s *messageSource) next() (*ProtocolMessage, error) {
+	for {
+		frame, err := s.frames.next()
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) && s.options.resync {
+			s.report(frame, err)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		msg := new(ProtocolMessage)
+		err = s.options.codec.Unmarshal(frame, msg, s.options.decodeMode)
+		if err == nil {
+			err = s.options.limits.check(msg)
+		}
+		if err == nil && s.validate {
+			err = msg.validate(s.options.passthrough)
+		}
+		if err == nil && msg.Type == MetaType {
+			if name, ok := msg.Meta[MetaKeyFraming]; ok {
+				var framing Framing
+				framing, err = ParseFraming(name)
+				if err == nil {
+					err = checkFraming(s.options.codec, framing)
+				}
+				if err == nil {
+					s.frames = newFrameReader(s.frames.remainder(), framing, s.options)
+					continue
+				}
+			}
+		}
+		if err != nil && s.options.resync {
+			s.report(frame, err)
+			continue
+		}
+		return msg, err
+	}
+}
+
+// report passes a bad frame to the onBadFrame callback, if any.
+func (s *messageSource) report(frame []byte, err error) {
+	if s.options.onBadFrame != nil {
+		s.options.onBadFrame(append([]byte(nil), frame...), err)
+	}
+}
@@ -0,0 +1,202 @@
+package arbor_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/jordwest/mock-conn"
+	"github.com/onsi/gomega"
+)
+
+// badFrame records a frame reported to a WithResync callback.
+type badFrame struct {
+	frame string
+	err   error
+}
+
+// TestResyncReader ensures that a reader in resync mode reports bad frames and
+// continues with the next line.
+func TestResyncReader(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	input := strings.Join([]string{
+		newExample,
+		"{\"Type\":2,\"UUID\":", // truncated
+		"",
+		"{\"Type\":1}", // missing UUID
+		welcomeExample,
+		queryExample, // no trailing newline
+	}, "\n")
+	var bad []badFrame
+	reader, err := arbor.NewProtocolReader(strings.NewReader(input), arbor.WithResync(func(frame []byte, err error) {
+		bad = append(bad, badFrame{frame: string(frame), err: err})
+	}))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	for _, expected := range []uint8{arbor.NewMessageType, arbor.WelcomeType, arbor.QueryType} {
+		msg := new(arbor.ProtocolMessage)
+		g.Expect(reader.Read(msg)).To(gomega.Succeed())
+		g.Expect(msg.Type).To(gomega.Equal(expected))
+	}
+	g.Expect(reader.Read(new(arbor.ProtocolMessage))).To(gomega.Equal(io.EOF))
+
+	g.Expect(bad).To(gomega.HaveLen(2))
+	g.Expect(bad[0].frame).To(gomega.Equal("{\"Type\":2,\"UUID\":\n"))
+	g.Expect(bad[1].frame).To(gomega.Equal("{\"Type\":1}\n"))
+	var validationErr *arbor.ValidationError
+	g.Expect(errors.As(bad[1].err, &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Field).To(gomega.Equal("UUID"))
+}
+
+// TestResyncReaderNilCallback ensures that bad frames are skipped when no callback is
+// given.
+func TestResyncReaderNilCallback(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	reader, err := arbor.NewProtocolReader(bytes.NewBufferString("\x1b\n"+newExample+"\n"), arbor.WithResync(nil))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	msg := new(arbor.ProtocolMessage)
+	g.Expect(reader.Read(msg)).To(gomega.Succeed())
+	g.Expect(msg.Type).To(gomega.Equal(uint8(arbor.NewMessageType)))
+}
+
+// TestMakeMessageReaderResync ensures that MakeMessageReader skips bad input instead of
+// hanging up in resync mode.
+func TestMakeMessageReaderResync(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	conn := mock_conn.NewConn()
+	reported := make(chan []byte, 1)
+	recvChan := arbor.MakeMessageReader(conn.Client, arbor.WithResync(func(frame []byte, err error) {
+		reported <- frame
+	}))
+	_, err := conn.Server.Write([]byte("\x1b\n" + newExample + "\n"))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(<-reported).To(gomega.Equal([]byte("\x1b\n")))
+	parsed := <-recvChan
+	g.Expect(parsed).ToNot(gomega.BeNil())
+	g.Expect(parsed.Type).To(gomega.Equal(uint8(arbor.NewMessageType)))
+	_, err = conn.Server.Write([]byte(queryExample + "\n"))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+}
+
+// TestVarintFraming ensures that messages survive length-prefixed framing.
+func TestVarintFraming(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	buf := new(bytes.Buffer)
+	writer, err := arbor.NewProtocolWriter(buf, arbor.WithFraming(arbor.FramingVarint))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	msgs := []*arbor.ProtocolMessage{getNew(), getWelcome(), getQuery()}
+	for _, msg := range msgs {
+		g.Expect(writer.Write(msg)).To(gomega.Succeed())
+	}
+	g.Expect(buf.Bytes()[0]).To(gomega.Equal(byte(len(marshalOrFail(t, msgs[0])))))
+
+	reader, err := arbor.NewProtocolReader(buf, arbor.WithFraming(arbor.FramingVarint))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	for _, msg := range msgs {
+		received := new(arbor.ProtocolMessage)
+		g.Expect(reader.Read(received)).To(gomega.Succeed())
+		g.Expect(received.Equals(msg)).To(gomega.BeTrue(), "expected %v, got %v", msg, received)
+	}
+	g.Expect(reader.Read(new(arbor.ProtocolMessage))).To(gomega.Equal(io.EOF))
+
+	reader, err = arbor.NewProtocolReader(bytes.NewBuffer([]byte{10, '{'}), arbor.WithFraming(arbor.FramingVarint))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(reader.Read(new(arbor.ProtocolMessage))).To(gomega.Equal(io.ErrUnexpectedEOF))
+}
+
+// TestVarintHugeLength ensures that a length prefix claiming an enormous frame is
+// rejected or read incrementally, rather than allocated up front, even when no
+// limits are configured.
+func TestVarintHugeLength(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, size := range []uint64{1 << 62, 1 << 40} {
+		prefix := make([]byte, binary.MaxVarintLen64)
+		prefix = prefix[:binary.PutUvarint(prefix, size)]
+		for _, codec := range []arbor.Codec{arbor.JSONCodec, arbor.CBORCodec} {
+			reader, err := arbor.NewProtocolReader(bytes.NewReader(append(prefix, '{')), arbor.WithFraming(arbor.FramingVarint), arbor.WithCodec(codec))
+			g.Expect(err).ToNot(gomega.HaveOccurred())
+			g.Expect(reader.Read(new(arbor.ProtocolMessage))).ToNot(gomega.Succeed())
+		}
+	}
+}
+
+// TestSwitchFraming ensures that readers follow a writer's switch to another framing,
+// whether or not they are in resync mode.
+func TestSwitchFraming(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	buf := new(bytes.Buffer)
+	writer, err := arbor.NewProtocolWriter(buf)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	before, after := getNew(), getQuery()
+	g.Expect(writer.Write(before)).To(gomega.Succeed())
+	g.Expect(writer.SwitchFraming(arbor.FramingVarint)).To(gomega.Succeed())
+	g.Expect(writer.SwitchFraming(arbor.FramingVarint)).To(gomega.Succeed())
+	g.Expect(writer.Write(after)).To(gomega.Succeed())
+	g.Expect(writer.SwitchFraming(arbor.Framing(99))).ToNot(gomega.Succeed())
+
+	for _, opts := range [][]arbor.Option{nil, {arbor.WithResync(nil)}} {
+		reader, err := arbor.NewProtocolReader(bytes.NewReader(buf.Bytes()), opts...)
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		for _, msg := range []*arbor.ProtocolMessage{before, after} {
+			received := new(arbor.ProtocolMessage)
+			g.Expect(reader.Read(received)).To(gomega.Succeed())
+			g.Expect(received.Equals(msg)).To(gomega.BeTrue(), "expected %v, got %v", msg, received)
+		}
+	}
+}
+
+// TestNegotiateFraming ensures that two peers can agree on a framing through META and
+// keep exchanging messages after switching.
+func TestNegotiateFraming(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server, client := connectedPair(t)
+	defer server.Close()
+	defer client.Close()
+	caps := arbor.Capabilities{Framings: []string{"varint", "newline"}}
+	for _, rw := range []*arbor.ProtocolReadWriter{server, client} {
+		rw := rw
+		go func() {
+			if err := rw.Write(caps.Meta()); err != nil {
+				t.Error("Unable to advertise capabilities", err)
+			}
+		}()
+	}
+	for _, rw := range []*arbor.ProtocolReadWriter{server, client} {
+		meta := new(arbor.ProtocolMessage)
+		g.Expect(rw.Read(meta)).To(gomega.Succeed())
+		peer, err := arbor.ParseCapabilities(meta)
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		framing := caps.Intersect(peer).PreferredFraming()
+		g.Expect(framing).To(gomega.Equal(arbor.FramingVarint))
+		rw := rw
+		go func() {
+			if err := rw.SwitchFraming(framing); err != nil {
+				t.Error("Unable to switch framing", err)
+			}
+			if err := rw.Write(getNew()); err != nil {
+				t.Error("Unable to write", err)
+			}
+		}()
+	}
+	for _, rw := range []*arbor.ProtocolReadWriter{server, client} {
+		received := new(arbor.ProtocolMessage)
+		g.Expect(rw.Read(received)).To(gomega.Succeed())
+		g.Expect(received.Equals(getNew())).To(gomega.BeTrue(), "got %v", received)
+	}
+}
+
+// TestMakeMessageVarint ensures that MakeMessageWriter and MakeMessageReader support
+// length-prefixed framing.
+func TestMakeMessageVarint(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	conn := mock_conn.NewConn()
+	output := arbor.MakeMessageWriter(conn.Server, arbor.WithFraming(arbor.FramingVarint))
+	input := arbor.MakeMessageReader(conn.Client, arbor.WithFraming(arbor.FramingVarint))
+	msg := getNew()
+	output <- msg
+	received := <-input
+	g.Expect(received.Equals(msg)).To(gomega.BeTrue())
+}
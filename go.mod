@@ -1,6 +1,6 @@
 module github.com/arborchat/arbor-go
 
-go 1.12
+go 1.13
 
 require (
 	github.com/jordwest/mock-conn v0.0.0-20180617021051-4896c6bd1641
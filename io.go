@@ -1,12 +1,13 @@
 package arbor
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"reflect"
 	"sync"
+	"time"
 )
 
 type closeable struct {
@@ -54,19 +55,30 @@ type ReadWriteCloser interface {
 type ProtocolReader struct {
 	closed bool
 	sync.RWMutex
-	in  chan *ProtocolMessage
-	out chan error
+	in chan chan readResult
+	// turn is held by the goroutine currently reading
+	turn chan struct{}
+	// pending receives the result of a read that was abandoned because its
+	// context ended. It is returned by the next read.
+	pending chan readResult
+	options options
 }
 
 // ensure ProtocolReader always fulfills the Reader interface
 var _ Reader = &ProtocolReader{}
 
+// readResult is the outcome of reading a single message.
+type readResult struct {
+	msg *ProtocolMessage
+	err error
+}
+
 func isNilPointer(in interface{}) bool {
 	return reflect.ValueOf(in).Kind() == reflect.Ptr && reflect.ValueOf(in).IsNil()
 }
 
 // NewProtocolReader wraps the source to make serializing *ProtocolMessages easy.
-func NewProtocolReader(source io.Reader) (*ProtocolReader, error) {
+func NewProtocolReader(source io.Reader, opts ...Option) (*ProtocolReader, error) {
 	if source == nil {
 		return nil, fmt.Errorf("NewProtocolReader cannot wrap nil")
 	}
@@ -74,39 +86,74 @@ func NewProtocolReader(source io.Reader) (*ProtocolReader, error) {
 		return nil, fmt.Errorf("NewProtocolReader given io.Reader typed nil")
 	}
 	reader := &ProtocolReader{
-		in:  make(chan *ProtocolMessage),
-		out: make(chan error),
+		in:      make(chan chan readResult),
+		turn:    make(chan struct{}, 1),
+		options: applyOptions(opts),
 	}
 	go reader.readLoop(source)
 	return reader, nil
 }
 
 func (r *ProtocolReader) readLoop(conn io.Reader) {
-	defer close(r.out)
-	decoder := json.NewDecoder(conn)
-	for msg := range r.in {
-		err := decoder.Decode(msg)
-		if err != nil {
-			r.out <- err
-		} else if !msg.IsValid() {
-			r.out <- fmt.Errorf("Read invalid message %v", msg)
-		} else {
-			r.out <- nil
+	source := newMessageSource(conn, r.options, true)
+	for results := range r.in {
+		msg, err := source.next()
+		if msg == nil {
+			msg = new(ProtocolMessage)
 		}
+		results <- readResult{msg: msg, err: err}
 	}
 }
 
 // Read attempts to read a JSON-serialized ProtocolMessage from the Reader's source
 // into the provided ProtocolMessage. If the provided message is nil, it will error.
-// This method will block until a ProtocolMessage becomes available.
+// This method will block until a ProtocolMessage becomes available. If the message
+// read is not valid (see ProtocolMessage.Validate), the error will be a *ValidationError.
 func (r *ProtocolReader) Read(into *ProtocolMessage) error {
+	return r.ReadContext(context.Background(), into)
+}
+
+// ReadContext is like Read, but gives up when ctx is done and returns ctx.Err().
+// The message that was being read when ctx ended is not lost. It is returned by the
+// next call to Read or ReadContext, and the provided ProtocolMessage is left untouched.
+func (r *ProtocolReader) ReadContext(ctx context.Context, into *ProtocolMessage) error {
+	if into == nil {
+		return fmt.Errorf("Cannot read into nil message")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case r.turn <- struct{}{}:
+		defer func() { <-r.turn }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if r.pending == nil {
+		if err := r.request(); err != nil {
+			return err
+		}
+	}
+	select {
+	case result := <-r.pending:
+		r.pending = nil
+		*into = *result.msg
+		return result.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// request asks readLoop for the next message. The caller must hold the turn.
+func (r *ProtocolReader) request() error {
 	r.RLock()
 	defer r.RUnlock()
 	if r.closed {
 		return fmt.Errorf("Reading from closed reader")
 	}
-	r.in <- into
-	return <-r.out
+	r.pending = make(chan readResult, 1)
+	r.in <- r.pending
+	return nil
 }
 
 func (r *ProtocolReader) stop() {
@@ -119,35 +166,45 @@ func (r *ProtocolReader) stop() {
 // ProtocolWriter writes arbor protocol messages (as JSON) to an io.Reader
 type ProtocolWriter struct {
 	sync.RWMutex
-	closed    bool
-	toWrite   chan *ProtocolMessage
-	writeErrs chan error
+	closed      bool
+	framing     Framing
+	codec       Codec
+	passthrough bool
+	toWrite     chan writeRequest
 }
 
 // ensure that ProtocolWriter satisfies the Writer interface at compile-time
 var _ Writer = &ProtocolWriter{}
 
+// writeRequest asks writeLoop to write an encoded message.
+type writeRequest struct {
+	data   []byte
+	result chan error
+}
+
 // NewProtocolWriter creates a ProtocolWriter by wrapping a destination io.Writer
-func NewProtocolWriter(destination io.Writer) (*ProtocolWriter, error) {
+func NewProtocolWriter(destination io.Writer, opts ...Option) (*ProtocolWriter, error) {
 	if destination == nil {
 		return nil, fmt.Errorf("NewProtocolWriter cannot wrap nil")
 	}
 	if isNilPointer(destination) {
 		return nil, fmt.Errorf("NewProtocolWriter given io.Writer typed nil")
 	}
+	config := applyOptions(opts)
 	writer := &ProtocolWriter{
-		toWrite:   make(chan *ProtocolMessage),
-		writeErrs: make(chan error),
+		framing:     config.framing,
+		codec:       config.codec,
+		passthrough: config.passthrough,
+		toWrite:     make(chan writeRequest),
 	}
 	go writer.writeLoop(destination)
 	return writer, nil
 }
 
 func (w *ProtocolWriter) writeLoop(conn io.Writer) {
-	defer close(w.writeErrs)
-	encoder := json.NewEncoder(conn)
-	for msg := range w.toWrite {
-		w.writeErrs <- encoder.Encode(msg)
+	for request := range w.toWrite {
+		_, err := conn.Write(request.data)
+		request.result <- err
 	}
 }
 
@@ -161,24 +218,95 @@ func (w *ProtocolWriter) stop() {
 // Write persists the given arbor protocol message into the ProtocolWriter's backing
 // io.Writer
 func (w *ProtocolWriter) Write(target *ProtocolMessage) error {
+	return w.WriteContext(context.Background(), target)
+}
+
+// WriteContext is like Write, but gives up when ctx is done and returns ctx.Err().
+// If ctx ends before the message is handed to the io.Writer, nothing is written.
+// If it ends afterward, the message may still be written in full later. Messages
+// are never partially interleaved.
+func (w *ProtocolWriter) WriteContext(ctx context.Context, target *ProtocolMessage) error {
 	if target == nil {
 		return fmt.Errorf("Cannot write nil message")
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	request := writeRequest{result: make(chan error, 1)}
+	if err := w.submit(ctx, target, request); err != nil {
+		return err
+	}
+	select {
+	case err := <-request.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// submit encodes the message into the request and hands it to writeLoop.
+func (w *ProtocolWriter) submit(ctx context.Context, target *ProtocolMessage, request writeRequest) error {
 	w.RLock()
 	defer w.RUnlock()
 	if w.closed {
 		return fmt.Errorf("Cannot write into closed Writer")
 	}
-	w.toWrite <- target
-	return <-w.writeErrs
+	data, err := encodeFrame(target, w.framing, w.codec, w.passthrough)
+	if err != nil {
+		return err
+	}
+	request.data = data
+	select {
+	case w.toWrite <- request:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SwitchFraming changes the framing used for subsequent messages. A META
+// message announcing the change is written first, using the old framing, so
+// that a ProtocolReader on the other end can follow along. Only switch to a
+// framing that the peer supports (see Capabilities.Framings).
+func (w *ProtocolWriter) SwitchFraming(framing Framing) error {
+	if _, err := ParseFraming(framing.String()); err != nil {
+		return err
+	}
+	w.Lock()
+	defer w.Unlock()
+	if err := checkFraming(w.codec, framing); err != nil {
+		return err
+	}
+	if w.closed {
+		return fmt.Errorf("Cannot write into closed Writer")
+	}
+	if framing == w.framing {
+		return nil
+	}
+	announcement := &ProtocolMessage{Type: MetaType, Meta: map[string]string{MetaKeyFraming: framing.String()}}
+	data, err := encodeFrame(announcement, w.framing, w.codec, w.passthrough)
+	if err != nil {
+		return err
+	}
+	request := writeRequest{data: data, result: make(chan error, 1)}
+	w.toWrite <- request
+	if err := <-request.result; err != nil {
+		return err
+	}
+	w.framing = framing
+	return nil
 }
 
 // ProtocolReadWriter can read and write arbor protocol messages (as JSON) from an io.ReadWriter
 type ProtocolReadWriter struct {
 	*ProtocolReader
 	*ProtocolWriter
-	closeReq chan struct{}
-	closeRes chan error
+	closeReq    chan struct{}
+	closeRes    chan error
+	done        chan struct{}
+	negotiation negotiation
+	keepalive   *keepalive
+	bye         *ProtocolMessage
 }
 
 // Ensure that ProtocolReadWriteCloser statisfies ReadWriteCloser at compile time
@@ -186,12 +314,12 @@ var _ ReadWriteCloser = &ProtocolReadWriter{}
 
 // NewProtocolReadWriter wraps the given io.ReadWriter so that it is possible to both read
 // and write arbor protocol messages to it.
-func NewProtocolReadWriter(wrap io.ReadWriteCloser) (*ProtocolReadWriter, error) {
-	reader, err := NewProtocolReader(wrap)
+func NewProtocolReadWriter(wrap io.ReadWriteCloser, opts ...Option) (*ProtocolReadWriter, error) {
+	reader, err := NewProtocolReader(wrap, opts...)
 	if err != nil {
 		return nil, err
 	}
-	writer, err := NewProtocolWriter(wrap)
+	writer, err := NewProtocolWriter(wrap, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -200,23 +328,50 @@ func NewProtocolReadWriter(wrap io.ReadWriteCloser) (*ProtocolReadWriter, error)
 		ProtocolWriter: writer,
 		closeReq:       make(chan struct{}),
 		closeRes:       make(chan error),
+		done:           make(chan struct{}),
 	}
 	go rw.closeWait(wrap)
+	config := applyOptions(opts)
+	rw.bye = config.bye
+	if config.keepaliveInterval > 0 {
+		rw.keepalive = &keepalive{
+			interval:  config.keepaliveInterval,
+			timeout:   config.keepaliveTimeout,
+			incoming:  make(chan readResult),
+			pongs:     make(chan *ProtocolMessage, 1),
+			lastHeard: time.Now(),
+		}
+		go rw.pump()
+		go rw.respond()
+		go rw.heartbeat()
+	}
 	return rw, nil
 }
 
 func (c *ProtocolReadWriter) closeWait(target io.Closer) {
 	defer close(c.closeRes)
 	<-c.closeReq
+	// closing the target first unblocks any reads or writes in progress
+	err := target.Close()
 	c.ProtocolReader.stop()
 	c.ProtocolWriter.stop()
-	c.closeRes <- target.Close()
+	close(c.done)
+	c.closeRes <- err
 }
 
 // Close both closes the io.ReadWriteCloser wrapped by this ProtocolReadWriter and tears down all
 // protocol-related internal structure. Once you close a ProtocolReadWriter, you must create a new
-// one in order to use it again.
-func (c *ProtocolReadWriter) Close() (err error) {
+// one in order to use it again. If a BYE message was configured with WithByeOnClose, it is sent
+// to the peer first.
+func (c *ProtocolReadWriter) Close() error {
+	if c.bye != nil {
+		c.farewell(c.bye)
+	}
+	return c.shutdown()
+}
+
+// shutdown tears down the ProtocolReadWriter and closes its io.ReadWriteCloser.
+func (c *ProtocolReadWriter) shutdown() (err error) {
 	defer func() {
 		recovered := recover()
 		if recovered == nil {
@@ -231,17 +386,20 @@ func (c *ProtocolReadWriter) Close() (err error) {
 
 // MakeMessageWriter wraps the io.Writer and returns a channel of
 // ProtocolMessage pointers. Any ProtocolMessage sent over that channel will be
-// written onto the io.Writer as JSON. This function handles all
-// marshalling. If a message fails to marshal for any reason, or if a write error
+// written onto the io.Writer as JSON, or with the codec chosen by WithCodec.
+// This function handles all marshalling. If a message fails to marshal for any reason, or if a write error
 // occurs, the returned channel will be closed and no further messages will be
 // written to the io.Writer.
-func MakeMessageWriter(conn io.Writer) chan<- *ProtocolMessage {
+func MakeMessageWriter(conn io.Writer, opts ...Option) chan<- *ProtocolMessage {
 	input := make(chan *ProtocolMessage)
+	config := applyOptions(opts)
 	go func() {
 		defer close(input)
-		encoder := json.NewEncoder(conn)
 		for message := range input {
-			err := encoder.Encode(message)
+			data, err := encodeFrame(message, config.framing, config.codec, config.passthrough)
+			if err == nil {
+				_, err = conn.Write(data)
+			}
 			if err != nil {
 				if err == io.EOF {
 					log.Println("Writer connection closed", err)
@@ -256,18 +414,19 @@ func MakeMessageWriter(conn io.Writer) chan<- *ProtocolMessage {
 }
 
 // MakeMessageReader wraps the io.ReadCloser and returns a channel of
-// ProtocolMessage pointers. Any JSON received over the io.ReadCloser will
-// be unmarshalled into an ProtocolMessage struct and sent over the returned
-// channel. If invalid JSON is received, the ReadCloser will close the io.ReadCloser
-// and the returned channel.
-func MakeMessageReader(conn io.ReadCloser) <-chan *ProtocolMessage {
+// ProtocolMessage pointers. Any JSON (or other encoding chosen by WithCodec)
+// received over the io.ReadCloser will be unmarshalled into an ProtocolMessage
+// struct and sent over the returned channel. If invalid JSON is received, the
+// ReadCloser will close the io.ReadCloser and the returned channel. With
+// WithResync, invalid JSON and invalid messages are skipped instead.
+func MakeMessageReader(conn io.ReadCloser, opts ...Option) <-chan *ProtocolMessage {
 	output := make(chan *ProtocolMessage)
+	config := applyOptions(opts)
 	go func() {
 		defer close(output)
-		decoder := json.NewDecoder(conn)
+		source := newMessageSource(conn, config, config.resync)
 		for {
-			a := &ProtocolMessage{}
-			err := decoder.Decode(a)
+			a, err := source.next()
 			if err != nil {
 				if err == io.EOF {
 					log.Println("Reader connection closed", err)
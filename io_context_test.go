@@ -0,0 +1,88 @@
+package arbor_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// TestReadContext ensures that an abandoned read does not lose or corrupt the message
+// being read.
+func TestReadContext(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	peerConn, conn := net.Pipe()
+	defer peerConn.Close()
+	defer conn.Close()
+	reader, err := arbor.NewProtocolReader(conn)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	into := getQuery()
+	g.Expect(reader.ReadContext(ctx, into)).To(gomega.Equal(context.DeadlineExceeded))
+	g.Expect(into.Equals(getQuery())).To(gomega.BeTrue())
+	g.Expect(reader.ReadContext(ctx, into)).To(gomega.Equal(context.DeadlineExceeded))
+
+	msg := getNew()
+	go func() { _ = json.NewEncoder(peerConn).Encode(msg) }()
+	g.Expect(reader.Read(into)).To(gomega.Succeed())
+	g.Expect(into.Equals(msg)).To(gomega.BeTrue(), "expected %v, got %v", msg, into)
+}
+
+// TestWriteContext ensures that writes can be abandoned without corrupting the
+// output.
+func TestWriteContext(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	buf := new(bytes.Buffer)
+	writer, err := arbor.NewProtocolWriter(buf)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g.Expect(writer.WriteContext(ctx, getNew())).To(gomega.Equal(context.Canceled))
+	g.Expect(buf.Len()).To(gomega.BeZero())
+
+	peerConn, conn := net.Pipe()
+	defer peerConn.Close()
+	defer conn.Close()
+	writer, err = arbor.NewProtocolWriter(conn)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	first, second := getNew(), getQuery()
+	g.Expect(writer.WriteContext(ctx, first)).To(gomega.Equal(context.DeadlineExceeded))
+
+	go func() {
+		if err := writer.Write(second); err != nil {
+			t.Error("Unable to write", err)
+		}
+	}()
+	decoder := json.NewDecoder(peerConn)
+	for _, expected := range []*arbor.ProtocolMessage{first, second} {
+		received := new(arbor.ProtocolMessage)
+		g.Expect(decoder.Decode(received)).To(gomega.Succeed())
+		g.Expect(received.Equals(expected)).To(gomega.BeTrue(), "expected %v, got %v", expected, received)
+	}
+}
+
+// TestReadWriterReadContext ensures that ReadContext honors cancellation when
+// keepalive is enabled.
+func TestReadWriterReadContext(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server, client := connectedPair(t, arbor.WithKeepalive(10*time.Millisecond, 0))
+	defer server.Close()
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	g.Expect(client.ReadContext(ctx, new(arbor.ProtocolMessage))).To(gomega.Equal(context.DeadlineExceeded))
+	msg := getNew()
+	go func() { _ = server.Write(msg) }()
+	received := new(arbor.ProtocolMessage)
+	g.Expect(client.Read(received)).To(gomega.Succeed())
+	g.Expect(received.Equals(msg)).To(gomega.BeTrue())
+}
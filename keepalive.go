@@ -0,0 +1,267 @@
+package arbor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrKeepaliveTimeout is returned by the Read method of a ProtocolReadWriter
+// that closed its connection because the peer stopped responding to PINGs.
+var ErrKeepaliveTimeout = errors.New("Peer stopped responding to keepalive pings")
+
+// NewPing creates a PING message. The peer should answer it with a PONG
+// carrying the same nonce (see NewPong).
+func NewPing(nonce string) *ProtocolMessage {
+	return &ProtocolMessage{
+		Type:  PingType,
+		Nonce: nonce,
+	}
+}
+
+// NewPong creates the PONG message that answers the given PING.
+func NewPong(ping *ProtocolMessage) *ProtocolMessage {
+	return &ProtocolMessage{
+		Type:  PongType,
+		Nonce: ping.Nonce,
+	}
+}
+
+// WithKeepalive enables keepalive on a ProtocolReadWriter. A PING is sent to
+// the peer every interval, and PINGs received from the peer are answered
+// automatically. PINGs and PONGs are never returned by Read. If nothing at all
+// is received from the peer for longer than timeout, the connection is closed
+// and Read returns ErrKeepaliveTimeout. Time spent waiting for the
+// application to call Read does not count toward the timeout. If timeout is
+// zero, it defaults to three intervals.
+//
+// The peer must answer PINGs, either by enabling keepalive itself or by
+// writing the result of NewPong for each PING that it reads.
+func WithKeepalive(interval, timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout == 0 {
+			timeout = 3 * interval
+		}
+		o.keepaliveInterval, o.keepaliveTimeout = interval, timeout
+	}
+}
+
+// keepalive tracks the liveness of a ProtocolReadWriter's peer.
+type keepalive struct {
+	sync.Mutex
+	interval, timeout time.Duration
+	// incoming carries messages other than PING and PONG to Read
+	incoming chan readResult
+	// pongs carries the PONGs waiting to be written
+	pongs chan *ProtocolMessage
+	// lastHeard is when the peer was last known to be alive
+	lastHeard time.Time
+	// delivering is true while a message waits to be returned by Read
+	delivering bool
+	// pinging is true while a PING is being written
+	pinging   bool
+	sequence  uint64
+	pingNonce string
+	pingSent  time.Time
+	latency   time.Duration
+	measured  bool
+	err       error
+}
+
+// heard records that the peer is alive.
+func (k *keepalive) heard() {
+	k.Lock()
+	defer k.Unlock()
+	k.lastHeard = time.Now()
+}
+
+// setDelivering records whether a message is waiting for Read. The timeout is
+// suspended while it is, since nothing more is read from the peer.
+func (k *keepalive) setDelivering(delivering bool) {
+	k.Lock()
+	defer k.Unlock()
+	k.delivering = delivering
+	k.lastHeard = time.Now()
+}
+
+// ponged records the round-trip time if the nonce answers the latest PING.
+func (k *keepalive) ponged(nonce string) {
+	k.Lock()
+	defer k.Unlock()
+	if nonce == k.pingNonce && !k.pingSent.IsZero() {
+		k.latency = time.Since(k.pingSent)
+		k.measured = true
+		k.pingSent = time.Time{}
+	}
+}
+
+// expired reports whether the peer has been silent for too long. If so, the
+// keepalive's error is set.
+func (k *keepalive) expired() bool {
+	k.Lock()
+	defer k.Unlock()
+	if k.delivering || time.Since(k.lastHeard) <= k.timeout {
+		return false
+	}
+	k.err = ErrKeepaliveTimeout
+	return true
+}
+
+// nextPing returns the PING to send, or nil if the previous one is still
+// being written.
+func (k *keepalive) nextPing() *ProtocolMessage {
+	k.Lock()
+	defer k.Unlock()
+	if k.pinging {
+		return nil
+	}
+	k.pinging = true
+	k.sequence++
+	k.pingNonce = strconv.FormatUint(k.sequence, 10)
+	k.pingSent = time.Now()
+	return NewPing(k.pingNonce)
+}
+
+// pinged records that a PING has been written.
+func (k *keepalive) pinged() {
+	k.Lock()
+	defer k.Unlock()
+	k.pinging = false
+}
+
+// failure returns the reason that the keepalive closed the connection, if any.
+func (k *keepalive) failure() error {
+	k.Lock()
+	defer k.Unlock()
+	return k.err
+}
+
+// pump reads every message from the peer, answering PINGs and consuming PONGs
+// and passing everything else on to Read.
+func (c *ProtocolReadWriter) pump() {
+	k := c.keepalive
+	for {
+		msg := new(ProtocolMessage)
+		err := c.ProtocolReader.Read(msg)
+		if err == nil {
+			k.heard()
+			switch msg.Type {
+			case PingType:
+				select {
+				case k.pongs <- NewPong(msg):
+				default:
+					// still answering an earlier PING, which is proof enough
+				}
+				continue
+			case PongType:
+				k.ponged(msg.Nonce)
+				continue
+			}
+		}
+		k.setDelivering(true)
+		select {
+		case k.incoming <- readResult{msg: msg, err: err}:
+		case <-c.done:
+			return
+		}
+		k.setDelivering(false)
+	}
+}
+
+// respond writes PONGs. They are written separately from pump so that
+// reading never waits on writing, which could deadlock two peers that ping
+// each other at the same moment.
+func (c *ProtocolReadWriter) respond() {
+	k := c.keepalive
+	for {
+		select {
+		case <-c.done:
+			return
+		case pong := <-k.pongs:
+			_ = c.ProtocolWriter.Write(pong)
+		}
+	}
+}
+
+// heartbeat sends PINGs and closes the connection if the peer falls silent.
+func (c *ProtocolReadWriter) heartbeat() {
+	k := c.keepalive
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if k.expired() {
+			// the peer is gone, so there is no point in saying BYE
+			_ = c.shutdown()
+			return
+		}
+		if ping := k.nextPing(); ping != nil {
+			// a write can block for a long time on a dead connection, so it
+			// must not delay checking the timeout
+			go func() {
+				defer k.pinged()
+				_ = c.ProtocolWriter.Write(ping)
+			}()
+		}
+	}
+}
+
+// Read reads the next message from the peer. See ProtocolReader.Read. If
+// keepalive is enabled (see WithKeepalive), PINGs and PONGs are handled
+// internally and never returned.
+func (c *ProtocolReadWriter) Read(into *ProtocolMessage) error {
+	return c.ReadContext(context.Background(), into)
+}
+
+// ReadContext is like Read, but gives up when ctx is done. See
+// ProtocolReader.ReadContext.
+func (c *ProtocolReadWriter) ReadContext(ctx context.Context, into *ProtocolMessage) error {
+	k := c.keepalive
+	if k == nil {
+		return c.ProtocolReader.ReadContext(ctx, into)
+	}
+	if into == nil {
+		return fmt.Errorf("Cannot read into nil message")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case result := <-k.incoming:
+		if result.err != nil {
+			if err := k.failure(); err != nil {
+				return err
+			}
+		}
+		*into = *result.msg
+		return result.err
+	case <-c.done:
+		if err := k.failure(); err != nil {
+			return err
+		}
+		return fmt.Errorf("Reading from closed reader")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Latency returns the round-trip time of the most recently answered PING. The
+// boolean result is false if keepalive is disabled or no PING has been
+// answered yet.
+func (c *ProtocolReadWriter) Latency() (time.Duration, bool) {
+	k := c.keepalive
+	if k == nil {
+		return 0, false
+	}
+	k.Lock()
+	defer k.Unlock()
+	return k.latency, k.measured
+}
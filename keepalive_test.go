@@ -0,0 +1,73 @@
+package arbor_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// TestPingPongMessages ensures that PING and PONG messages validate and survive
+// serialization.
+func TestPingPongMessages(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	ping := arbor.NewPing("1")
+	pong := arbor.NewPong(ping)
+	g.Expect(pong.Nonce).To(gomega.Equal(ping.Nonce))
+	for _, msg := range []*arbor.ProtocolMessage{ping, pong} {
+		g.Expect(msg.Validate()).To(gomega.Succeed())
+		decoded := &arbor.ProtocolMessage{}
+		g.Expect(arbor.UnmarshalProtocolMessage([]byte(marshalOrFail(t, msg)), decoded, arbor.DecodeStrict)).To(gomega.Succeed())
+		g.Expect(decoded.Equals(msg)).To(gomega.BeTrue(), "expected %v, got %v", msg, decoded)
+	}
+	g.Expect(arbor.NewPing("").IsValid()).To(gomega.BeFalse())
+	pong.ChatMessage = &arbor.ChatMessage{UUID: testID1}
+	g.Expect(pong.IsValid()).To(gomega.BeFalse())
+}
+
+// TestKeepalive ensures that peers with keepalive enabled measure latency and never
+// return PINGs or PONGs from Read.
+func TestKeepalive(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server, client := connectedPair(t, arbor.WithKeepalive(10*time.Millisecond, time.Second))
+	defer server.Close()
+	defer client.Close()
+	_, measured := client.Latency()
+	g.Expect(measured).To(gomega.BeFalse())
+	g.Eventually(func() bool {
+		_, measured := client.Latency()
+		return measured
+	}).Should(gomega.BeTrue())
+
+	msg := getNew()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := server.Write(msg); err != nil {
+			t.Error("Unable to write", err)
+		}
+	}()
+	received := new(arbor.ProtocolMessage)
+	g.Expect(client.Read(received)).To(gomega.Succeed())
+	g.Expect(received.Equals(msg)).To(gomega.BeTrue())
+	latency, _ := server.Latency()
+	g.Expect(latency).To(gomega.BeNumerically(">", 0))
+}
+
+// TestKeepaliveTimeout ensures that a connection to an unresponsive peer is closed
+// with ErrKeepaliveTimeout.
+func TestKeepaliveTimeout(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	peerConn, conn := net.Pipe()
+	defer peerConn.Close()
+	go func() { _, _ = io.Copy(ioutil.Discard, peerConn) }()
+	rw, err := arbor.NewProtocolReadWriter(conn, arbor.WithKeepalive(10*time.Millisecond, 50*time.Millisecond))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	start := time.Now()
+	g.Expect(rw.Read(new(arbor.ProtocolMessage))).To(gomega.Equal(arbor.ErrKeepaliveTimeout))
+	g.Expect(time.Since(start)).To(gomega.BeNumerically(">=", 50*time.Millisecond))
+	g.Expect(rw.Write(getNew())).ToNot(gomega.Succeed())
+}
@@ -0,0 +1,59 @@
+package arbor
+
+import "fmt"
+
+// Limits restricts the size of the messages that a reader accepts, to protect
+// against peers that send enormous messages. A limit of zero means that there
+// is no limit.
+type Limits struct {
+	// MaxFrameSize is the size in bytes of the largest encoded message
+	// accepted. Oversized messages are skipped without being held in memory.
+	// When it is set, messages in FramingNewline must be followed by a
+	// newline, as in resync mode (see WithResync).
+	MaxFrameSize int
+	// MaxContentLength is the length in bytes of the longest Content accepted.
+	MaxContentLength int
+	// MaxRecent is the largest number of entries in Recent accepted.
+	MaxRecent int
+	// MaxMetaEntries is the largest number of entries in Meta accepted.
+	MaxMetaEntries int
+}
+
+// WithLimits makes a reader reject messages that exceed the given limits. A
+// message that exceeds them is not returned. Instead, Read returns a
+// *LimitError, and the reader moves on to the next message. In resync mode,
+// the message is passed to the bad frame callback instead.
+func WithLimits(limits Limits) Option {
+	return func(o *options) {
+		o.limits = limits
+	}
+}
+
+// LimitError reports that a message exceeded one of a reader's Limits.
+type LimitError struct {
+	// Limit is the name of the Limits field that was exceeded.
+	Limit string
+	// Max is the value of the limit.
+	Max int
+	// Size is the size of the message or field. For a message that was not
+	// read in full, it is only a lower bound.
+	Size int
+}
+
+// Error describes the limit that was exceeded.
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("Message exceeds %s: %d is greater than %d", e.Limit, e.Size, e.Max)
+}
+
+// check returns a *LimitError if the decoded message exceeds the limits.
+func (l Limits) check(m *ProtocolMessage) error {
+	switch {
+	case l.MaxContentLength > 0 && m.ChatMessage != nil && len(m.Content) > l.MaxContentLength:
+		return &LimitError{Limit: "MaxContentLength", Max: l.MaxContentLength, Size: len(m.Content)}
+	case l.MaxRecent > 0 && len(m.Recent) > l.MaxRecent:
+		return &LimitError{Limit: "MaxRecent", Max: l.MaxRecent, Size: len(m.Recent)}
+	case l.MaxMetaEntries > 0 && len(m.Meta) > l.MaxMetaEntries:
+		return &LimitError{Limit: "MaxMetaEntries", Max: l.MaxMetaEntries, Size: len(m.Meta)}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package arbor_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// expectLimit asserts that err is a *LimitError for the named limit.
+func expectLimit(g *gomega.GomegaWithT, err error, limit string) {
+	var limitErr *arbor.LimitError
+	g.Expect(errors.As(err, &limitErr)).To(gomega.BeTrue(), "expected a LimitError, got %v", err)
+	g.Expect(limitErr.Limit).To(gomega.Equal(limit))
+	g.Expect(limitErr.Size).To(gomega.BeNumerically(">", limitErr.Max))
+}
+
+// bigNew returns a NEW message with Content of the given length.
+func bigNew(length int) *arbor.ProtocolMessage {
+	msg := getNew()
+	msg.Content = strings.Repeat("a", length)
+	return msg
+}
+
+// TestFrameSizeLimit ensures that oversized frames are rejected and skipped in every
+// framing.
+func TestFrameSizeLimit(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, framing := range []arbor.Framing{arbor.FramingNewline, arbor.FramingVarint} {
+		buf := new(bytes.Buffer)
+		writer, err := arbor.NewProtocolWriter(buf, arbor.WithFraming(framing))
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		g.Expect(writer.Write(bigNew(100000))).To(gomega.Succeed())
+		g.Expect(writer.Write(getNew())).To(gomega.Succeed())
+
+		reader, err := arbor.NewProtocolReader(buf, arbor.WithFraming(framing), arbor.WithLimits(arbor.Limits{MaxFrameSize: 1024}))
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		expectLimit(g, reader.Read(new(arbor.ProtocolMessage)), "MaxFrameSize")
+		received := new(arbor.ProtocolMessage)
+		g.Expect(reader.Read(received)).To(gomega.Succeed(), "using %v framing", framing)
+		g.Expect(received.Equals(getNew())).To(gomega.BeTrue())
+	}
+}
+
+// TestFieldLimits ensures that messages with too much content, too many recent
+// messages, or too many meta entries are rejected.
+func TestFieldLimits(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	limits := arbor.Limits{MaxContentLength: 10, MaxRecent: 1, MaxMetaEntries: 1}
+	meta := getMeta()
+	meta.Meta["another"] = "entry"
+	for limit, msg := range map[string]*arbor.ProtocolMessage{
+		"MaxContentLength": bigNew(11),
+		"MaxRecent":        getWelcome(),
+		"MaxMetaEntries":   meta,
+	} {
+		reader, err := arbor.NewProtocolReader(strings.NewReader(marshalOrFail(t, msg)+"\n"+marshalOrFail(t, bigNew(10))), arbor.WithLimits(limits))
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		expectLimit(g, reader.Read(new(arbor.ProtocolMessage)), limit)
+		g.Expect(reader.Read(new(arbor.ProtocolMessage))).To(gomega.Succeed())
+	}
+}
+
+// TestLimitsResync ensures that messages exceeding limits are reported as bad frames
+// in resync mode.
+func TestLimitsResync(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	input := marshalOrFail(t, bigNew(5000)) + "\n" + marshalOrFail(t, bigNew(200)) + "\n" + marshalOrFail(t, getNew()) + "\n"
+	var bad []badFrame
+	reader, err := arbor.NewProtocolReader(strings.NewReader(input),
+		arbor.WithLimits(arbor.Limits{MaxFrameSize: 1024, MaxContentLength: 100}),
+		arbor.WithResync(func(frame []byte, err error) {
+			bad = append(bad, badFrame{frame: string(frame), err: err})
+		}))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	received := new(arbor.ProtocolMessage)
+	g.Expect(reader.Read(received)).To(gomega.Succeed())
+	g.Expect(received.Equals(getNew())).To(gomega.BeTrue())
+	g.Expect(bad).To(gomega.HaveLen(2))
+	g.Expect(bad[0].frame).To(gomega.HaveLen(1024))
+	expectLimit(g, bad[0].err, "MaxFrameSize")
+	expectLimit(g, bad[1].err, "MaxContentLength")
+}
@@ -1,46 +1,545 @@
 package arbor
 
+import (
+	"container/list"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrStoreClosed is returned when attempting to use a Store after it has
+// been closed.
+var ErrStoreClosed = errors.New("Store is closed")
+
+// MessageStore defines the behavior of types that hold ChatMessages and
+// allow them to be looked up by their identifiers. Implementations must be
+// safe for concurrent use.
+type MessageStore interface {
+	// Get retrieves the message with the given UUID, or nil if there is no
+	// such message.
+	Get(uuid string) *ChatMessage
+	// Add inserts the message, replacing any existing message with the same UUID.
+	Add(msg *ChatMessage)
+	// Has reports whether a message with the given UUID is present.
+	Has(uuid string) bool
+	// Delete removes the message with the given UUID, if present. Replies to
+	// the message are not removed.
+	Delete(uuid string)
+	// Range calls f for each message until f returns false. The order is not
+	// specified. f may safely call other methods on the store.
+	Range(f func(*ChatMessage) bool)
+}
+
+// TreeStore defines the behavior of MessageStores that can answer questions
+// about the reply tree formed by their messages.
+type TreeStore interface {
+	MessageStore
+	// Children returns the messages whose Parent is the given UUID.
+	Children(uuid string) []*ChatMessage
+	// Ancestors returns the chain of messages above the given message, nearest first.
+	Ancestors(uuid string) []*ChatMessage
+	// Subtree returns the given message followed by its descendants up to
+	// depth levels below it, or all of them if depth is negative.
+	Subtree(uuid string, depth int) []*ChatMessage
+	// Leaves returns every message that has no replies.
+	Leaves() []*ChatMessage
+}
+
+// ensure that Store fulfills the TreeStore interface at compile-time
+var _ TreeStore = &Store{}
+
 // Store is a data structure that holds ChatMessages and allows them
 // to be easily looked up by their identifiers. It is safe for
 // concurrent use.
+//
+// In addition to lookups by identifier, the Store maintains an index of
+// the reply tree formed by the messages' Parent fields so that it can
+// answer questions about the structure of a conversation, and an index of
+// the words in each message's Content for use by Search.
+//
+// Each Store runs a goroutine to coordinate access to its contents. Call
+// Close to stop it once the Store is no longer needed.
 type Store struct {
-	m        map[string]*ChatMessage
-	add      chan *ChatMessage
-	request  chan string
-	response chan *ChatMessage
+	m             map[string]*ChatMessage
+	children      map[string][]string
+	added         map[string]uint64
+	seq           uint64
+	root          string
+	limits        StoreLimits
+	lru           *list.List
+	elements      map[string]*list.Element
+	subscriptions map[*Subscription]struct{}
+	words         postings
+	history       map[string][]*ChatMessage
+	deleted       map[string]struct{}
+	add           chan *ChatMessage
+	ops           chan func()
+	quit          chan struct{}
+	done          chan struct{}
+	closeMu       sync.Mutex
+	closed        bool
 }
 
-// NewStore creates a Store that is ready to be used.
+// NewStore creates a Store that is ready to be used. The Store holds every
+// message that it is given; see NewBoundedStore for an alternative.
 func NewStore() *Store {
-	s := &Store{
-		m:        make(map[string]*ChatMessage),
-		add:      make(chan *ChatMessage),
-		request:  make(chan string),
-		response: make(chan *ChatMessage),
-	}
+	s := newStore()
 	go s.dispatch()
 	return s
 }
 
+// newStore allocates a Store without starting its goroutine.
+func newStore() *Store {
+	return &Store{
+		m:             make(map[string]*ChatMessage),
+		children:      make(map[string][]string),
+		added:         make(map[string]uint64),
+		subscriptions: make(map[*Subscription]struct{}),
+		words:         make(postings),
+		history:       make(map[string][]*ChatMessage),
+		deleted:       make(map[string]struct{}),
+		add:           make(chan *ChatMessage),
+		ops:           make(chan func()),
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
 func (s *Store) dispatch() {
+	defer close(s.done)
+	var sweep <-chan time.Time
+	if s.limits.MaxAge > 0 {
+		ticker := time.NewTicker(s.limits.sweepInterval())
+		defer ticker.Stop()
+		sweep = ticker.C
+	}
 	for {
 		select {
+		case now := <-sweep:
+			s.expire(now)
 		case msg := <-s.add:
-			s.m[msg.UUID] = msg
-		case id := <-s.request:
-			value := s.m[id]
-			s.response <- value
+			s.insert(msg)
+		case op := <-s.ops:
+			op()
+		case <-s.quit:
+			s.drain()
+			s.endSubscriptions()
+			return
 		}
 	}
 }
 
-// Get retrieves the message with a UUID from the store.
+// drain services any requests that were already waiting when the Store was
+// closed.
+func (s *Store) drain() {
+	for {
+		select {
+		case msg := <-s.add:
+			s.insert(msg)
+		case op := <-s.ops:
+			op()
+		default:
+			return
+		}
+	}
+}
+
+// doContext runs the provided function on the Store's dispatch goroutine and
+// waits for it to complete. The function may safely access the Store's
+// internal state. If the context is cancelled before the function completes,
+// doContext returns immediately, though the function may still run later.
+func (s *Store) doContext(ctx context.Context, op func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	select {
+	case s.ops <- func() {
+		defer close(done)
+		op()
+	}:
+	case <-s.done:
+		return ErrStoreClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do is like doContext, but cannot be cancelled. If the Store is closed, op
+// is not run.
+func (s *Store) do(op func()) {
+	_ = s.doContext(context.Background(), op)
+}
+
+// insert adds msg to the store and updates the child index. It must only be
+// called from the dispatch goroutine.
+func (s *Store) insert(msg *ChatMessage) {
+	if _, deleted := s.deleted[msg.UUID]; deleted {
+		msg = tombstone(msg)
+	}
+	if old, ok := s.m[msg.UUID]; ok {
+		s.unlink(old)
+		s.unindex(old)
+	}
+	s.m[msg.UUID] = msg
+	s.children[msg.Parent] = append(s.children[msg.Parent], msg.UUID)
+	s.index(msg)
+	s.seq++
+	s.added[msg.UUID] = s.seq
+	s.notify(msg)
+	if s.limits.bounded() {
+		s.touch(msg.UUID)
+		s.enforceLimits(msg)
+	}
+}
+
+// remove deletes the message with the given id from the store and the child
+// index. It must only be called from the dispatch goroutine.
+func (s *Store) remove(id string) {
+	if msg, ok := s.m[id]; ok {
+		s.unlink(msg)
+		s.unindex(msg)
+		s.forget(id)
+		delete(s.m, id)
+		delete(s.added, id)
+		delete(s.history, id)
+		delete(s.deleted, id)
+	}
+}
+
+// unlink removes msg from the child list of its parent. It must only be called
+// from the dispatch goroutine.
+func (s *Store) unlink(msg *ChatMessage) {
+	siblings := s.children[msg.Parent]
+	for i, id := range siblings {
+		if id == msg.UUID {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(s.children, msg.Parent)
+	} else {
+		s.children[msg.Parent] = siblings
+	}
+}
+
+// Get retrieves the message with a UUID from the store. It returns nil if
+// the Store has been closed.
 func (s *Store) Get(uuid string) *ChatMessage {
-	s.request <- uuid
-	return <-s.response
+	msg, _ := s.GetContext(context.Background(), uuid)
+	return msg
+}
+
+// GetContext retrieves the message with a UUID from the store. It returns an
+// error if the context is done before the lookup completes or if the Store
+// has been closed. A nil message with a nil error means that the message is
+// not in the store.
+func (s *Store) GetContext(ctx context.Context, uuid string) (*ChatMessage, error) {
+	var msg *ChatMessage
+	if err := s.doContext(ctx, func() {
+		msg = s.m[uuid]
+		s.touch(uuid)
+	}); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
-// Add inserts the given message into the store.
+// Add inserts the given message into the store. It does nothing if the Store
+// has been closed.
 func (s *Store) Add(msg *ChatMessage) {
-	s.add <- msg
+	_ = s.AddContext(context.Background(), msg)
+}
+
+// AddContext inserts the given message into the store. It returns an error
+// if the context is done before the Store accepts the message or if the
+// Store has been closed.
+func (s *Store) AddContext(ctx context.Context, msg *ChatMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case s.add <- msg:
+		return nil
+	case <-s.done:
+		return ErrStoreClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the Store's internal goroutine once any requests that are
+// already waiting have been handled. After Close, lookups behave as though
+// the Store is empty and additions are ignored; the context-aware methods
+// return ErrStoreClosed. Closing a Store more than once returns
+// ErrStoreClosed.
+func (s *Store) Close() error {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	s.closed = true
+	close(s.quit)
+	<-s.done
+	return nil
+}
+
+// Has reports whether a message with the given UUID is in the store.
+func (s *Store) Has(uuid string) bool {
+	var present bool
+	s.do(func() {
+		_, present = s.m[uuid]
+	})
+	return present
+}
+
+// Delete removes the message with the given UUID from the store. Replies to
+// the message remain in the store and can still be found with Children.
+func (s *Store) Delete(uuid string) {
+	s.do(func() {
+		s.remove(uuid)
+	})
+}
+
+// Range calls f for each message in the store until f returns false. The
+// messages are visited in no particular order. Range operates on a snapshot
+// of the store, so f may safely call other methods on the Store.
+func (s *Store) Range(f func(*ChatMessage) bool) {
+	var snapshot []*ChatMessage
+	s.do(func() {
+		snapshot = make([]*ChatMessage, 0, len(s.m))
+		for _, msg := range s.m {
+			snapshot = append(snapshot, msg)
+		}
+	})
+	for _, msg := range snapshot {
+		if !f(msg) {
+			return
+		}
+	}
+}
+
+// Children returns the messages in the store whose Parent is the given id,
+// in the order in which they were added. The message with the given id does
+// not need to be present in the store.
+func (s *Store) Children(id string) []*ChatMessage {
+	var children []*ChatMessage
+	s.do(func() {
+		children = make([]*ChatMessage, 0, len(s.children[id]))
+		for _, child := range s.children[id] {
+			children = append(children, s.m[child])
+		}
+	})
+	return children
+}
+
+// Ancestors returns the chain of messages above the message with the given
+// id, starting with its parent and ending with the root of the tree. The walk
+// stops early if a message along the way is not present in the store. The
+// message with the given id is not included in the results.
+func (s *Store) Ancestors(id string) []*ChatMessage {
+	var ancestors []*ChatMessage
+	s.do(func() {
+		ancestors = []*ChatMessage{}
+		visited := map[string]struct{}{id: {}}
+		current, ok := s.m[id]
+		for ok && current.Parent != "" {
+			if _, seen := visited[current.Parent]; seen {
+				// the messages form a cycle, stop walking
+				break
+			}
+			visited[current.Parent] = struct{}{}
+			current, ok = s.m[current.Parent]
+			if ok {
+				ancestors = append(ancestors, current)
+			}
+		}
+	})
+	return ancestors
+}
+
+// Subtree returns the message with the given id followed by its descendants
+// in breadth-first order. Only descendants at most depth levels below the
+// message are included, so a depth of zero returns just the message itself.
+// A negative depth places no limit on the size of the subtree. If the message
+// is not in the store, Subtree returns nil.
+func (s *Store) Subtree(id string, depth int) []*ChatMessage {
+	var subtree []*ChatMessage
+	s.do(func() {
+		root, ok := s.m[id]
+		if !ok {
+			return
+		}
+		subtree = []*ChatMessage{root}
+		visited := map[string]struct{}{id: {}}
+		level := []string{id}
+		for d := 0; len(level) > 0 && (depth < 0 || d < depth); d++ {
+			var next []string
+			for _, parent := range level {
+				for _, child := range s.children[parent] {
+					if _, seen := visited[child]; seen {
+						continue
+					}
+					visited[child] = struct{}{}
+					subtree = append(subtree, s.m[child])
+					next = append(next, child)
+				}
+			}
+			level = next
+		}
+	})
+	return subtree
+}
+
+// Leaves returns every message in the store that has no replies in the store.
+// The order of the results is not specified.
+func (s *Store) Leaves() []*ChatMessage {
+	var leaves []*ChatMessage
+	s.do(func() {
+		leaves = []*ChatMessage{}
+		for id, msg := range s.m {
+			if len(s.children[id]) == 0 {
+				leaves = append(leaves, msg)
+			}
+		}
+	})
+	return leaves
+}
+
+// SetRoot configures the UUID of the root message of this store's tree. The
+// root is advertised in WELCOME messages created by Welcome. The root message
+// does not need to be present in the store.
+func (s *Store) SetRoot(uuid string) {
+	s.do(func() {
+		s.root = uuid
+	})
+}
+
+// Root returns the UUID configured with SetRoot, or the empty string if no
+// root has been configured.
+func (s *Store) Root() string {
+	var root string
+	s.do(func() {
+		root = s.root
+	})
+	return root
+}
+
+// Recent returns the UUIDs of the n most recent messages in the store, newest
+// first. Messages are ordered by Timestamp, and messages with the same
+// Timestamp are ordered by when they were added to the store.
+func (s *Store) Recent(n int) []string {
+	recent := []string{}
+	s.do(func() {
+		recent = s.recent(n)
+	})
+	return recent
+}
+
+// recent implements Recent. It must only be called from the dispatch goroutine.
+func (s *Store) recent(n int) []string {
+	if n <= 0 {
+		return []string{}
+	}
+	ids := make([]string, 0, len(s.m))
+	for id := range s.m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := s.m[ids[i]], s.m[ids[j]]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp > b.Timestamp
+		}
+		return s.added[ids[i]] > s.added[ids[j]]
+	})
+	if len(ids) > n {
+		ids = ids[:n]
+	}
+	return ids
+}
+
+// Welcome creates a WELCOME message advertising this store's root and its n
+// most recent messages (see Recent). The protocol version is set to the
+// version implemented by this package. It returns an error if no root has
+// been configured with SetRoot.
+func (s *Store) Welcome(n int) (*ProtocolMessage, error) {
+	welcome := &ProtocolMessage{
+		Type:  WelcomeType,
+		Major: ProtocolMajor,
+		Minor: ProtocolMinor,
+	}
+	if err := s.doContext(context.Background(), func() {
+		welcome.Root = s.root
+		welcome.Recent = s.recent(n)
+	}); err != nil {
+		return nil, err
+	}
+	if welcome.Root == "" {
+		return nil, errors.New("Cannot create WELCOME without a root, use SetRoot")
+	}
+	return welcome, nil
+}
+
+// MissingParents returns the UUIDs of messages that are the Parent of some
+// message in the store but are not in the store themselves, in sorted order.
+// These are the messages that must be requested from a peer in order to fill
+// gaps in the store's history.
+func (s *Store) MissingParents() []string {
+	missing := []string{}
+	s.do(func() {
+		missing = s.missingParents()
+	})
+	return missing
+}
+
+// missingParents implements MissingParents. It must only be called from the
+// dispatch goroutine.
+func (s *Store) missingParents() []string {
+	missing := []string{}
+	for parent := range s.children {
+		if _, ok := s.m[parent]; !ok && parent != "" {
+			missing = append(missing, parent)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Orphans returns the messages in the store whose Parent is not in the store.
+// Messages without a Parent are never orphans. Once a missing parent is
+// added, its replies are no longer orphans and are linked into the tree.
+func (s *Store) Orphans() []*ChatMessage {
+	orphans := []*ChatMessage{}
+	s.do(func() {
+		for _, parent := range s.missingParents() {
+			for _, child := range s.children[parent] {
+				orphans = append(orphans, s.m[child])
+			}
+		}
+	})
+	return orphans
+}
+
+// BackfillQueries returns a QUERY message for each of the store's missing
+// parents (see MissingParents). Sending them to a peer and adding the
+// responses will link the store's orphaned messages into the tree, though
+// the responses may themselves have missing parents.
+func (s *Store) BackfillQueries() []*ProtocolMessage {
+	missing := s.MissingParents()
+	queries := make([]*ProtocolMessage, len(missing))
+	for i, id := range missing {
+		queries[i] = NewQuery(id)
+	}
+	return queries
 }
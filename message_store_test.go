@@ -1,11 +1,15 @@
 package arbor_test
 
 import (
+	"context"
 	"math/rand"
 	"strconv"
+	"sync"
 	"testing"
 
 	arbor "github.com/arborchat/arbor-go"
+	"github.com/arborchat/arbor-go/storetest"
+	"github.com/onsi/gomega"
 )
 
 // TestNewStore ensures that NewStore returns a store.
@@ -23,6 +27,13 @@ func randomMessage() *arbor.ChatMessage {
 	return m
 }
 
+// TestStoreConformance runs the shared MessageStore test suite against Store.
+func TestStoreConformance(t *testing.T) {
+	storetest.Run(t, func(*testing.T) arbor.MessageStore {
+		return arbor.NewStore()
+	})
+}
+
 const iterations = 10000
 
 // TestAddAndGet ensures that any message inserted into the store with "Add" can be
@@ -74,3 +85,210 @@ func TestGetNotAdded(t *testing.T) {
 		t.Error("Recieved non-nil message when getting a non-existent message ID", m)
 	}
 }
+
+// buildTree adds a small conversation tree to the store and returns its messages.
+// The shape of the tree is:
+//
+//	root
+//	├── a
+//	│   ├── c
+//	│   └── d
+//	└── b
+func buildTree(s *arbor.Store) map[string]*arbor.ChatMessage {
+	tree := map[string]*arbor.ChatMessage{
+		"root": {UUID: "root", Content: "root"},
+		"a":    {UUID: "a", Parent: "root", Content: "a"},
+		"b":    {UUID: "b", Parent: "root", Content: "b"},
+		"c":    {UUID: "c", Parent: "a", Content: "c"},
+		"d":    {UUID: "d", Parent: "a", Content: "d"},
+	}
+	for _, id := range []string{"root", "a", "b", "c", "d"} {
+		s.Add(tree[id])
+	}
+	return tree
+}
+
+func ids(msgs []*arbor.ChatMessage) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.UUID
+	}
+	return out
+}
+
+// TestChildren ensures that Children returns the replies to a message in the order
+// that they were added.
+func TestChildren(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	buildTree(s)
+	g.Expect(ids(s.Children("root"))).To(gomega.Equal([]string{"a", "b"}))
+	g.Expect(ids(s.Children("a"))).To(gomega.Equal([]string{"c", "d"}))
+	g.Expect(s.Children("b")).To(gomega.BeEmpty())
+	g.Expect(s.Children(nonexsitentID)).To(gomega.BeEmpty())
+}
+
+// TestChildrenReAdd ensures that adding a message twice does not duplicate it in the
+// child index, and that changing its parent moves it within the tree.
+func TestChildrenReAdd(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	tree := buildTree(s)
+	s.Add(tree["c"])
+	g.Expect(ids(s.Children("a"))).To(gomega.ConsistOf("c", "d"))
+	moved := *tree["d"]
+	moved.Parent = "b"
+	s.Add(&moved)
+	g.Expect(ids(s.Children("a"))).To(gomega.Equal([]string{"c"}))
+	g.Expect(ids(s.Children("b"))).To(gomega.Equal([]string{"d"}))
+}
+
+// TestAncestors ensures that Ancestors walks from a message's parent up to the root.
+func TestAncestors(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	buildTree(s)
+	g.Expect(ids(s.Ancestors("c"))).To(gomega.Equal([]string{"a", "root"}))
+	g.Expect(s.Ancestors("root")).To(gomega.BeEmpty())
+	g.Expect(s.Ancestors(nonexsitentID)).To(gomega.BeEmpty())
+	s.Add(&arbor.ChatMessage{UUID: "orphan", Parent: nonexsitentID})
+	g.Expect(s.Ancestors("orphan")).To(gomega.BeEmpty())
+}
+
+// TestSubtree ensures that Subtree returns a message and its descendants limited by depth.
+func TestSubtree(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	buildTree(s)
+	g.Expect(ids(s.Subtree("root", -1))).To(gomega.Equal([]string{"root", "a", "b", "c", "d"}))
+	g.Expect(ids(s.Subtree("root", 1))).To(gomega.Equal([]string{"root", "a", "b"}))
+	g.Expect(ids(s.Subtree("a", 0))).To(gomega.Equal([]string{"a"}))
+	g.Expect(s.Subtree(nonexsitentID, -1)).To(gomega.BeNil())
+}
+
+// TestLeaves ensures that Leaves returns exactly the messages without replies.
+func TestLeaves(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	g.Expect(s.Leaves()).To(gomega.BeEmpty())
+	buildTree(s)
+	g.Expect(ids(s.Leaves())).To(gomega.ConsistOf("b", "c", "d"))
+}
+
+// TestStoreClose ensures that a closed Store rejects further use with a clear error.
+func TestStoreClose(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	msg := randomMessage()
+	s.Add(msg)
+	g.Expect(s.Close()).To(gomega.Succeed())
+	g.Expect(s.Close()).To(gomega.Equal(arbor.ErrStoreClosed))
+	g.Expect(s.AddContext(context.Background(), randomMessage())).To(gomega.Equal(arbor.ErrStoreClosed))
+	_, err := s.GetContext(context.Background(), msg.UUID)
+	g.Expect(err).To(gomega.Equal(arbor.ErrStoreClosed))
+	// the non-context methods must not block or panic
+	s.Add(randomMessage())
+	g.Expect(s.Get(msg.UUID)).To(gomega.BeNil())
+	g.Expect(s.Has(msg.UUID)).To(gomega.BeFalse())
+	g.Expect(s.Children("")).To(gomega.BeEmpty())
+}
+
+// TestStoreCloseDrains ensures that requests waiting when the Store is closed are
+// handled rather than left blocked forever.
+func TestStoreCloseDrains(t *testing.T) {
+	s := arbor.NewStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := randomMessage()
+			s.Add(msg)
+			s.Get(msg.UUID)
+		}()
+	}
+	if err := s.Close(); err != nil {
+		t.Error("Unable to close store", err)
+	}
+	wg.Wait()
+}
+
+// TestStoreContextCancelled ensures that the context-aware methods honor cancellation.
+func TestStoreContextCancelled(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.GetContext(ctx, nonexsitentID)
+	g.Expect(err).To(gomega.Equal(context.Canceled))
+	g.Expect(s.AddContext(ctx, randomMessage())).To(gomega.Equal(context.Canceled))
+}
+
+// TestWelcome ensures that the store can produce a valid WELCOME message listing its
+// most recent messages.
+func TestWelcome(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	_, err := s.Welcome(2)
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	s.SetRoot("root")
+	g.Expect(s.Root()).To(gomega.Equal("root"))
+	welcome, err := s.Welcome(2)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(welcome.IsValidWelcome()).To(gomega.BeTrue())
+	g.Expect(welcome.Recent).To(gomega.BeEmpty())
+
+	tree := buildTree(s)
+	for i, id := range []string{"root", "a", "b", "c", "d"} {
+		tree[id].Timestamp = int64(i)
+	}
+	// "c" and "d" share a timestamp, so "d" is newer because it was added later
+	tree["c"].Timestamp = tree["d"].Timestamp
+	for _, id := range []string{"root", "a", "b", "c", "d"} {
+		s.Add(tree[id])
+	}
+	welcome, err = s.Welcome(3)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(welcome.IsValidWelcome()).To(gomega.BeTrue())
+	g.Expect(welcome.Root).To(gomega.Equal("root"))
+	g.Expect(welcome.Recent).To(gomega.Equal([]string{"d", "c", "b"}))
+	g.Expect(welcome.Major).To(gomega.Equal(uint8(arbor.ProtocolMajor)))
+	g.Expect(welcome.Minor).To(gomega.Equal(uint8(arbor.ProtocolMinor)))
+	g.Expect(s.Recent(10)).To(gomega.HaveLen(5))
+}
+
+// TestBackfill ensures that the store tracks messages whose parents are unknown and
+// produces the queries needed to find them.
+func TestBackfill(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	s.Add(&arbor.ChatMessage{UUID: "root"})
+	s.Add(&arbor.ChatMessage{UUID: "c", Parent: "b"})
+	s.Add(&arbor.ChatMessage{UUID: "d", Parent: "b"})
+	s.Add(&arbor.ChatMessage{UUID: "e", Parent: "x"})
+	g.Expect(s.MissingParents()).To(gomega.Equal([]string{"b", "x"}))
+	g.Expect(ids(s.Orphans())).To(gomega.ConsistOf("c", "d", "e"))
+	queries := s.BackfillQueries()
+	g.Expect(queries).To(gomega.HaveLen(2))
+	for i, id := range []string{"b", "x"} {
+		g.Expect(queries[i].IsValidQuery()).To(gomega.BeTrue())
+		g.Expect(queries[i].UUID).To(gomega.Equal(id))
+	}
+
+	// the response to a query may have its own missing parent
+	s.Add(&arbor.ChatMessage{UUID: "b", Parent: "a"})
+	g.Expect(s.MissingParents()).To(gomega.Equal([]string{"a", "x"}))
+	g.Expect(ids(s.Orphans())).To(gomega.ConsistOf("b", "e"))
+	g.Expect(ids(s.Children("b"))).To(gomega.Equal([]string{"c", "d"}))
+
+	s.Add(&arbor.ChatMessage{UUID: "a", Parent: "root"})
+	s.Add(&arbor.ChatMessage{UUID: "x", Parent: "root"})
+	g.Expect(s.MissingParents()).To(gomega.BeEmpty())
+	g.Expect(s.Orphans()).To(gomega.BeEmpty())
+	g.Expect(s.BackfillQueries()).To(gomega.BeEmpty())
+	g.Expect(ids(s.Ancestors("c"))).To(gomega.Equal([]string{"b", "a", "root"}))
+}
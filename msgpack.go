@@ -0,0 +1,242 @@
+package arbor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// encodeMsgPack encodes a JSON value tree as MessagePack.
+func encodeMsgPack(tree interface{}) ([]byte, error) {
+	return appendMsgPack(nil, tree)
+}
+
+// appendMsgPackLength appends the smallest header for a string, array, or
+// map of length n. The header begins with one of the given bytes: fixed holds
+// lengths below limit within itself, and the others are followed by an 8, 16,
+// or 32-bit length. There is no 8-bit form if b8 is zero.
+func appendMsgPackLength(buf []byte, n int, fixed byte, limit int, b8, b16, b32 byte) ([]byte, error) {
+	switch {
+	case n < limit:
+		return append(buf, fixed|byte(n)), nil
+	case n <= math.MaxUint8 && b8 != 0:
+		return appendUint(append(buf, b8), uint64(n), 1), nil
+	case n <= math.MaxUint16:
+		return appendUint(append(buf, b16), uint64(n), 2), nil
+	case uint64(n) <= math.MaxUint32:
+		return appendUint(append(buf, b32), uint64(n), 4), nil
+	default:
+		return nil, fmt.Errorf("Too long to encode as MessagePack")
+	}
+}
+
+func appendMsgPackUint(buf []byte, u uint64) []byte {
+	switch {
+	case u < 0x80:
+		return append(buf, byte(u))
+	case u <= math.MaxUint8:
+		return appendUint(append(buf, 0xcc), u, 1)
+	case u <= math.MaxUint16:
+		return appendUint(append(buf, 0xcd), u, 2)
+	case u <= math.MaxUint32:
+		return appendUint(append(buf, 0xce), u, 4)
+	default:
+		return appendUint(append(buf, 0xcf), u, 8)
+	}
+}
+
+func appendMsgPackInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendMsgPackUint(buf, uint64(i))
+	case i >= -32:
+		return append(buf, byte(i))
+	case i >= math.MinInt8:
+		return appendUint(append(buf, 0xd0), uint64(i), 1)
+	case i >= math.MinInt16:
+		return appendUint(append(buf, 0xd1), uint64(i), 2)
+	case i >= math.MinInt32:
+		return appendUint(append(buf, 0xd2), uint64(i), 4)
+	default:
+		return appendUint(append(buf, 0xd3), uint64(i), 8)
+	}
+}
+
+func appendMsgPack(buf []byte, value interface{}) ([]byte, error) {
+	var err error
+	switch v := value.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if v {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case string:
+		if buf, err = appendMsgPackLength(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb); err != nil {
+			return nil, err
+		}
+		return append(buf, v...), nil
+	case json.Number:
+		kind, i, u, f, err := number(v)
+		switch {
+		case err != nil:
+			return nil, err
+		case kind == 'i':
+			return appendMsgPackInt(buf, i), nil
+		case kind == 'u':
+			return appendMsgPackUint(buf, u), nil
+		default:
+			return appendUint(append(buf, 0xcb), math.Float64bits(f), 8), nil
+		}
+	case []interface{}:
+		if buf, err = appendMsgPackLength(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd); err != nil {
+			return nil, err
+		}
+		for _, item := range v {
+			if buf, err = appendMsgPack(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]interface{}:
+		if buf, err = appendMsgPackLength(buf, len(v), 0x80, 16, 0, 0xde, 0xdf); err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if buf, err = appendMsgPack(buf, key); err != nil {
+				return nil, err
+			}
+			if buf, err = appendMsgPack(buf, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	default:
+		return nil, fmt.Errorf("Cannot encode %T as MessagePack", value)
+	}
+}
+
+// decodeMsgPack decodes a single MessagePack object into a JSON value tree.
+func decodeMsgPack(data []byte) (interface{}, error) {
+	d := &treeDecoder{data: data}
+	return d.finish(d.msgpack(0))
+}
+
+func (d *treeDecoder) msgpack(depth int) (interface{}, error) {
+	if depth > maxTreeDepth {
+		return nil, fmt.Errorf("MessagePack nested too deeply")
+	}
+	first, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	b := first[0]
+	switch {
+	case b <= 0x7f:
+		return json.Number(strconv.Itoa(int(b))), nil
+	case b >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(b)))), nil
+	case b <= 0x8f:
+		return d.msgpackMap(uint64(b&0x0f), depth)
+	case b <= 0x9f:
+		return d.msgpackArray(uint64(b&0x0f), depth)
+	case b <= 0xbf:
+		return d.msgpackString(uint64(b & 0x1f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xca:
+		bits, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return floatNumber(float64(math.Float32frombits(uint32(bits))))
+	case 0xcb:
+		bits, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return floatNumber(math.Float64frombits(bits))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.uint(1 << (b - 0xcc))
+		return json.Number(strconv.FormatUint(u, 10)), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		width := 1 << (b - 0xd0)
+		u, err := d.uint(width)
+		shift := uint(64 - 8*width)
+		return json.Number(strconv.FormatInt(int64(u<<shift)>>shift, 10)), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackString(n)
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackMap(n, depth)
+	}
+	return nil, fmt.Errorf("Unsupported MessagePack format 0x%x", b)
+}
+
+func (d *treeDecoder) msgpackString(n uint64) (interface{}, error) {
+	text, err := d.take(n)
+	return string(text), err
+}
+
+func (d *treeDecoder) msgpackArray(length uint64, depth int) (interface{}, error) {
+	n, err := d.count(length)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]interface{}, n)
+	for i := range items {
+		if items[i], err = d.msgpack(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func (d *treeDecoder) msgpackMap(length uint64, depth int) (interface{}, error) {
+	n, err := d.count(length)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.msgpack(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("MessagePack map keys must be strings")
+		}
+		if fields[name], err = d.msgpack(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,45 @@
+package arbor
+
+import "time"
+
+// Option configures the behavior of a ProtocolReader, ProtocolWriter, or
+// ProtocolReadWriter. Options that do not apply to the type being created are
+// ignored.
+type Option func(*options)
+
+// options holds the configuration assembled from a list of Options.
+type options struct {
+	decodeMode        DecodeMode
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	bye               *ProtocolMessage
+	resync            bool
+	onBadFrame        func([]byte, error)
+	framing           Framing
+	limits            Limits
+	codec             Codec
+	passthrough       bool
+}
+
+// applyOptions returns the configuration described by opts.
+func applyOptions(opts []Option) options {
+	config := options{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.codec == nil {
+		config.codec = JSONCodec
+	}
+	if lengthPrefixed(config.codec) {
+		config.framing = FramingVarint
+	}
+	return config
+}
+
+// WithDecodeMode sets how a reader handles fields that are not used by the type
+// of the message being read. The default is DecodeLenient.
+func WithDecodeMode(mode DecodeMode) Option {
+	return func(o *options) {
+		o.decodeMode = mode
+	}
+}
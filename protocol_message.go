@@ -3,6 +3,14 @@ package arbor
 import (
 	"encoding/json"
 	"fmt"
+	"time"
+)
+
+const (
+	// ProtocolMajor is the major version number of the Arbor protocol implemented by this package
+	ProtocolMajor = 0
+	// ProtocolMinor is the minor version number of the Arbor protocol implemented by this package
+	ProtocolMinor = 1
 )
 
 const (
@@ -16,6 +24,24 @@ const (
 	NewType = 2
 	// MetaType is the `Type` of a META Message
 	MetaType = 3
+	// EditType is the `Type` of an EDIT Message
+	EditType = 4
+	// DeleteType is the `Type` of a DELETE Message
+	DeleteType = 5
+	// BatchQueryType is the `Type` of a BATCH_QUERY Message
+	BatchQueryType = 6
+	// AncestorsQueryType is the `Type` of an ANCESTORS_QUERY Message
+	AncestorsQueryType = 7
+	// DescendantsQueryType is the `Type` of a DESCENDANTS_QUERY Message
+	DescendantsQueryType = 8
+	// PingType is the `Type` of a PING Message
+	PingType = 9
+	// PongType is the `Type` of a PONG Message
+	PongType = 10
+	// ErrorType is the `Type` of an ERROR Message
+	ErrorType = 11
+	// ByeType is the `Type` of a BYE Message
+	ByeType = 12
 )
 
 // Message is a protocol-layer message in Arbor
@@ -29,17 +55,78 @@ type ProtocolMessage struct {
 	// Recent is only used in WELCOME messages and provides a list of recently-sent message ids
 	Recent []string
 	// The type of the message, should be one of the constants defined in this
-	// package.
+	// package or a type registered with RegisterType.
 	Type uint8
 	// Major is only used in WELCOME messages and identifies the major version number of the protocol version in use
 	Major uint8
 	// Minor is only used in WELCOME messages and identifies the minor version number of the protocol version in use
 	Minor uint8
-	// Message is the actual chat message content, if any. This is currently only
-	// used in NEW_MESSAGE messages
+	// Message is the actual chat message content, if any. This is used in
+	// NEW_MESSAGE messages, and some of its fields are used by QUERY, EDIT,
+	// and DELETE messages
 	*ChatMessage
+	// Target is used in EDIT and DELETE messages to identify the message being changed, and
+	// in ERROR messages to identify the message being rejected
+	Target string
+	// IDs is only used in BATCH_QUERY messages and lists the ids of the requested messages
+	IDs []string
+	// Depth is only used in ANCESTORS_QUERY messages and limits how many ancestors are requested
+	Depth int
+	// Since is only used in DESCENDANTS_QUERY messages and limits the request to messages
+	// with a Timestamp no earlier than this
+	Since int64
+	// Nonce is only used in PING and PONG messages and pairs each PONG with the PING it answers
+	Nonce string
+	// Code is only used in ERROR and BYE messages and is a machine-readable description of the
+	// problem or of the reason for disconnecting
+	Code string
+	// Text is only used in ERROR and BYE messages and is a human-readable version of Code
+	Text string
+	// RetryAfter is only used in BYE messages and is the number of seconds that the peer should
+	// wait before reconnecting. Zero means that no hint is given.
+	RetryAfter int64
 	// Meta is the `Meta` field in META type arbor messages.
 	Meta map[string]string
+	// Extra holds fields that were not recognized when the message was decoded
+	// with DecodePreserve. They are included when the message is marshalled
+	// unless they conflict with the message's own fields. Extra is ignored by
+	// Equals.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// NewQuery creates a QUERY message requesting the message with the given UUID.
+func NewQuery(uuid string) *ProtocolMessage {
+	return &ProtocolMessage{
+		Type:        QueryType,
+		ChatMessage: &ChatMessage{UUID: uuid},
+	}
+}
+
+// NewEdit creates an EDIT message that replaces the Content of the target
+// message. Only the author of the target message may edit it.
+func NewEdit(target, username, content string) *ProtocolMessage {
+	return &ProtocolMessage{
+		Type:   EditType,
+		Target: target,
+		ChatMessage: &ChatMessage{
+			Username:  username,
+			Content:   content,
+			Timestamp: time.Now().Unix(),
+		},
+	}
+}
+
+// NewDelete creates a DELETE message that retracts the target message. Only
+// the author of the target message may delete it.
+func NewDelete(target, username string) *ProtocolMessage {
+	return &ProtocolMessage{
+		Type:   DeleteType,
+		Target: target,
+		ChatMessage: &ChatMessage{
+			Username:  username,
+			Timestamp: time.Now().Unix(),
+		},
+	}
 }
 
 // Equals returns true if other is equivalent to the message (has the same data or is the same message)
@@ -52,13 +139,13 @@ func (m *ProtocolMessage) Equals(other *ProtocolMessage) bool {
 		// either both nil or pointers to the same address
 		return true
 	}
-	if m.Type != other.Type || m.Root != other.Root || m.Major != other.Major || m.Minor != other.Minor {
+	if m.Type != other.Type || m.Root != other.Root || m.Major != other.Major || m.Minor != other.Minor || m.Target != other.Target || m.Depth != other.Depth || m.Since != other.Since || m.Nonce != other.Nonce || m.Code != other.Code || m.Text != other.Text || m.RetryAfter != other.RetryAfter {
 		return false
 	}
 	if !m.ChatMessage.Equals(other.ChatMessage) {
 		return false
 	}
-	if !sameSlice(m.Recent, other.Recent) {
+	if !sameSlice(m.Recent, other.Recent) || !sameSlice(m.IDs, other.IDs) {
 		return false
 	}
 	if !sameMap(m.Meta, other.Meta) {
@@ -98,35 +185,32 @@ func sameMap(a, b map[string]string) bool {
 	return true
 }
 
-// MarshalJSON transforms a ProtocolMessage into JSON
+// MarshalJSON transforms a ProtocolMessage into JSON, including only the fields
+// used by its type (see RegisterType).
 func (m *ProtocolMessage) MarshalJSON() ([]byte, error) {
-	switch m.Type {
-	case WelcomeType:
-		return json.Marshal(struct {
-			Root   string
-			Recent []string
-			Type   uint8
-			Major  uint8
-			Minor  uint8
-		}{Type: m.Type, Root: m.Root, Recent: m.Recent, Major: m.Major, Minor: m.Minor})
-	case QueryType:
-		return json.Marshal(struct {
-			UUID string
-			Type uint8
-		}{UUID: m.UUID, Type: m.Type})
-	case NewMessageType:
-		return json.Marshal(struct {
-			*ChatMessage
-			Type uint8
-		}{ChatMessage: m.ChatMessage, Type: m.Type})
-	case MetaType:
-		return json.Marshal(struct {
-			Meta map[string]string
-			Type uint8
-		}{Type: m.Type, Meta: m.Meta})
-	default:
+	spec, ok := LookupType(m.Type)
+	if !ok {
 		return nil, fmt.Errorf("Unknown message type, could not marshal")
 	}
+	return m.marshalWith(spec)
+}
+
+// marshalWith transforms a ProtocolMessage into JSON as described by spec.
+func (m *ProtocolMessage) marshalWith(spec TypeSpec) ([]byte, error) {
+	data, err := json.Marshal(spec.Shape(m))
+	if err != nil || len(m.Extra) == 0 {
+		return data, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range m.Extra {
+		if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
 }
 
 // String returns a JSON representation of the message as a string.
@@ -137,88 +221,27 @@ func (m *ProtocolMessage) String() string {
 }
 
 // IsValid returns whether the message has the minimum correct fields for its message
-// type.
+// type. Use Validate to find out what is wrong with an invalid message.
 func (m *ProtocolMessage) IsValid() bool {
-	switch m.Type {
-	case WelcomeType:
-		return m.IsValidWelcome()
-	case QueryType:
-		return m.IsValidQuery()
-	case NewMessageType:
-		return m.IsValidNew()
-	case MetaType:
-		return m.IsValidMeta()
-	default:
-		return false
-	}
+	return m.Validate() == nil
 }
 
 // IsValidWelcome checks that the message is a valid Welcome message.
 func (m *ProtocolMessage) IsValidWelcome() bool {
-	switch {
-	case m.Type != WelcomeType:
-		fallthrough
-	case m.Major == 0 && m.Minor == 0:
-		fallthrough
-	case m.Recent == nil:
-		fallthrough
-	case m.Meta != nil && len(m.Meta) != 0:
-		fallthrough
-	case m.Root == "":
-		return false
-	}
-	return true
+	return m.validateWelcome() == nil
 }
 
 // IsValidNew checks that the message is a valid New message.
 func (m *ProtocolMessage) IsValidNew() bool {
-	switch {
-	case m.Type != NewMessageType:
-		fallthrough
-	case m.ChatMessage == nil:
-		fallthrough
-	case m.Username == "":
-		fallthrough
-	case m.Content == "":
-		fallthrough
-	case m.Meta != nil && len(m.Meta) != 0:
-		fallthrough
-	case m.Timestamp == 0:
-		return false
-	}
-	return true
+	return m.validateNew() == nil
 }
 
 // IsValidQuery checks that the message is a valid Query message.
 func (m *ProtocolMessage) IsValidQuery() bool {
-	switch {
-	case m.Type != QueryType:
-		fallthrough
-	case m.ChatMessage == nil:
-		fallthrough
-	case m.Meta != nil && len(m.Meta) != 0:
-		fallthrough
-	case m.UUID == "":
-		return false
-	}
-	return true
+	return m.validateQuery() == nil
 }
 
 // IsValidMeta returns whether the message is valid as a META-type protocol message.
 func (m *ProtocolMessage) IsValidMeta() bool {
-	switch {
-	case m.Type != MetaType:
-		fallthrough
-	case m.Meta == nil:
-		fallthrough
-	case m.ChatMessage != nil:
-		fallthrough
-	case m.Major != 0 || m.Minor != 0:
-		fallthrough
-	case m.Root != "":
-		fallthrough
-	case m.Recent != nil:
-		return false
-	}
-	return true
+	return m.validateMeta() == nil
 }
@@ -0,0 +1,125 @@
+package arbor
+
+import (
+	"fmt"
+)
+
+// NewBatchQuery creates a BATCH_QUERY message requesting every message with one
+// of the given ids.
+func NewBatchQuery(ids ...string) *ProtocolMessage {
+	return &ProtocolMessage{
+		Type: BatchQueryType,
+		IDs:  ids,
+	}
+}
+
+// NewAncestorsQuery creates an ANCESTORS_QUERY message requesting the message
+// with the given UUID and up to depth of its ancestors. A depth of zero
+// requests every ancestor.
+func NewAncestorsQuery(uuid string, depth int) *ProtocolMessage {
+	return &ProtocolMessage{
+		Type:        AncestorsQueryType,
+		ChatMessage: &ChatMessage{UUID: uuid},
+		Depth:       depth,
+	}
+}
+
+// NewDescendantsQuery creates a DESCENDANTS_QUERY message requesting the
+// message with the given UUID and all of its descendants with a Timestamp no
+// earlier than since. A since of zero requests every descendant.
+func NewDescendantsQuery(uuid string, since int64) *ProtocolMessage {
+	return &ProtocolMessage{
+		Type:        DescendantsQueryType,
+		ChatMessage: &ChatMessage{UUID: uuid},
+		Since:       since,
+	}
+}
+
+// QueryResults finds the messages in store requested by a QUERY, BATCH_QUERY,
+// ANCESTORS_QUERY, or DESCENDANTS_QUERY message. Requested messages that are
+// not in the store are left out. The results are ordered so that every
+// message precedes its replies, which allows a client to add them to its own
+// store as they arrive.
+func QueryResults(store TreeStore, query *ProtocolMessage) ([]*ChatMessage, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	results := []*ChatMessage{}
+	switch query.Type {
+	case QueryType:
+		if msg := store.Get(query.UUID); msg != nil {
+			results = append(results, msg)
+		}
+	case BatchQueryType:
+		var requested []*ChatMessage
+		for _, id := range query.IDs {
+			if msg := store.Get(id); msg != nil {
+				requested = append(requested, msg)
+			}
+		}
+		results = topologicalOrder(requested)
+	case AncestorsQueryType:
+		msg := store.Get(query.UUID)
+		if msg == nil {
+			break
+		}
+		ancestors := store.Ancestors(query.UUID)
+		if query.Depth > 0 && len(ancestors) > query.Depth {
+			ancestors = ancestors[:query.Depth]
+		}
+		for i := len(ancestors) - 1; i >= 0; i-- {
+			results = append(results, ancestors[i])
+		}
+		results = append(results, msg)
+	case DescendantsQueryType:
+		for _, msg := range store.Subtree(query.UUID, -1) {
+			if msg.Timestamp >= query.Since {
+				results = append(results, msg)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Cannot answer %s message", typeName(query.Type))
+	}
+	return results, nil
+}
+
+// topologicalOrder reorders messages as little as possible so that every
+// message precedes its replies within the list. Duplicates are removed.
+func topologicalOrder(msgs []*ChatMessage) []*ChatMessage {
+	byID := make(map[string]*ChatMessage, len(msgs))
+	for _, msg := range msgs {
+		byID[msg.UUID] = msg
+	}
+	ordered := make([]*ChatMessage, 0, len(byID))
+	placed := map[string]bool{}
+	var place func(msg *ChatMessage)
+	place = func(msg *ChatMessage) {
+		if placed[msg.UUID] {
+			return
+		}
+		placed[msg.UUID] = true
+		if parent, ok := byID[msg.Parent]; ok {
+			place(parent)
+		}
+		ordered = append(ordered, msg)
+	}
+	for _, msg := range msgs {
+		place(msg)
+	}
+	return ordered
+}
+
+// AnswerQuery finds the messages requested by query (see QueryResults) and
+// writes each of them to w as a NEW message.
+func AnswerQuery(store TreeStore, query *ProtocolMessage, w Writer) error {
+	results, err := QueryResults(store, query)
+	if err != nil {
+		return err
+	}
+	for _, msg := range results {
+		if err := w.Write(&ProtocolMessage{Type: NewMessageType, ChatMessage: msg}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package arbor_test
+
+import (
+	"bytes"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// TestRangeQueryMessages ensures that the batch and range query types validate and
+// survive serialization.
+func TestRangeQueryMessages(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, query := range []*arbor.ProtocolMessage{
+		arbor.NewBatchQuery(testID1, testID2),
+		arbor.NewAncestorsQuery(testID1, 3),
+		arbor.NewDescendantsQuery(testID1, 1537738224),
+	} {
+		g.Expect(query.Validate()).To(gomega.Succeed())
+		decoded := &arbor.ProtocolMessage{}
+		g.Expect(arbor.UnmarshalProtocolMessage([]byte(marshalOrFail(t, query)), decoded, arbor.DecodeStrict)).To(gomega.Succeed())
+		g.Expect(decoded.Equals(query)).To(gomega.BeTrue(), "expected %v, got %v", query, decoded)
+	}
+	g.Expect(arbor.NewBatchQuery().IsValid()).To(gomega.BeFalse())
+	g.Expect(arbor.NewAncestorsQuery("", 1).IsValid()).To(gomega.BeFalse())
+	g.Expect(arbor.NewAncestorsQuery(testID1, -1).IsValid()).To(gomega.BeFalse())
+	g.Expect(arbor.NewDescendantsQuery("", 0).IsValid()).To(gomega.BeFalse())
+
+	// queries without a ChatMessage can still be described
+	for _, query := range []*arbor.ProtocolMessage{
+		{Type: arbor.QueryType},
+		{Type: arbor.AncestorsQueryType},
+		{Type: arbor.DescendantsQueryType},
+	} {
+		g.Expect(query.String()).To(gomega.ContainSubstring(`"UUID":""`))
+		g.Expect(query.Validate()).To(gomega.MatchError(gomega.ContainSubstring("UUID")))
+	}
+}
+
+// TestQueryResults ensures that each kind of query is answered from the store with
+// parents before their replies.
+func TestQueryResults(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	tree := buildTree(s)
+	for i, id := range []string{"root", "a", "b", "c", "d"} {
+		tree[id].Timestamp = int64(i + 1)
+	}
+	results := func(query *arbor.ProtocolMessage) []string {
+		msgs, err := arbor.QueryResults(s, query)
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		return ids(msgs)
+	}
+	g.Expect(results(arbor.NewQuery("c"))).To(gomega.Equal([]string{"c"}))
+	g.Expect(results(arbor.NewQuery(nonexsitentID))).To(gomega.BeEmpty())
+	g.Expect(results(arbor.NewBatchQuery("d", nonexsitentID, "b", "a", "d"))).To(gomega.Equal([]string{"a", "d", "b"}))
+	g.Expect(results(arbor.NewAncestorsQuery("c", 0))).To(gomega.Equal([]string{"root", "a", "c"}))
+	g.Expect(results(arbor.NewAncestorsQuery("c", 1))).To(gomega.Equal([]string{"a", "c"}))
+	g.Expect(results(arbor.NewAncestorsQuery(nonexsitentID, 1))).To(gomega.BeEmpty())
+	g.Expect(results(arbor.NewDescendantsQuery("root", 0))).To(gomega.Equal([]string{"root", "a", "b", "c", "d"}))
+	g.Expect(results(arbor.NewDescendantsQuery("a", 5))).To(gomega.Equal([]string{"d"}))
+	_, err := arbor.QueryResults(s, getWelcome())
+	g.Expect(err).To(gomega.HaveOccurred())
+}
+
+// TestAnswerQuery ensures that query results are written as NEW messages.
+func TestAnswerQuery(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	tree := buildTree(s)
+	for _, msg := range tree {
+		msg.Username, msg.Timestamp = testUser, 1
+	}
+	buf := new(bytes.Buffer)
+	writer, err := arbor.NewProtocolWriter(buf)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(arbor.AnswerQuery(s, arbor.NewAncestorsQuery("d", 0), writer)).To(gomega.Succeed())
+
+	reader, err := arbor.NewProtocolReader(buf)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	for _, id := range []string{"root", "a", "d"} {
+		msg := new(arbor.ProtocolMessage)
+		g.Expect(reader.Read(msg)).To(gomega.Succeed())
+		g.Expect(msg.Type).To(gomega.Equal(uint8(arbor.NewMessageType)))
+		g.Expect(msg.ChatMessage.Equals(tree[id])).To(gomega.BeTrue())
+	}
+}
@@ -0,0 +1,302 @@
+package arbor
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TypeSpec describes how messages of a particular Type are serialized and
+// validated. Every message type, including the ones built into this package,
+// is described by a TypeSpec registered with RegisterType.
+type TypeSpec struct {
+	// Name is a human-readable name for the type, such as "WELCOME".
+	Name string
+	// Shape returns the value to serialize in place of the message. This is
+	// usually an anonymous struct holding only the fields used by the type,
+	// including Type itself.
+	Shape func(*ProtocolMessage) interface{}
+	// Fields lists the JSON keys, other than Type, that messages of this type
+	// may contain. When decoding, other keys are treated as described by
+	// DecodeMode. If Fields is nil, every field is accepted.
+	Fields []string
+	// Validate returns nil if the message has the minimum correct fields for
+	// the type. Otherwise it should return a *ValidationError.
+	Validate func(*ProtocolMessage) error
+}
+
+// registry holds the TypeSpec of every known message type.
+var registry = struct {
+	sync.RWMutex
+	types map[uint8]TypeSpec
+}{types: make(map[uint8]TypeSpec)}
+
+// RegisterType makes a new message type known to this package, so that messages
+// with that Type can be marshalled and validated. It returns an error if the
+// type number is already in use or the spec is incomplete.
+func RegisterType(messageType uint8, spec TypeSpec) error {
+	if spec.Shape == nil || spec.Validate == nil {
+		return fmt.Errorf("TypeSpec for message type %d must provide Shape and Validate", messageType)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if existing, ok := registry.types[messageType]; ok {
+		return fmt.Errorf("Message type %d is already registered as %s", messageType, existing.Name)
+	}
+	registry.types[messageType] = spec
+	return nil
+}
+
+// LookupType returns the TypeSpec registered for the given message type.
+func LookupType(messageType uint8) (TypeSpec, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	spec, ok := registry.types[messageType]
+	return spec, ok
+}
+
+// WithUnknownTypePassthrough controls how a reader or writer handles messages
+// with unregistered types. By default they are invalid and cannot be written.
+// With passthrough, a reader accepts them as valid and a writer writes every
+// field that is set, so that software such as relays can forward message
+// types that it does not understand. Only the codecs built into this package
+// can write such messages.
+func WithUnknownTypePassthrough() Option {
+	return func(o *options) {
+		o.passthrough = true
+	}
+}
+
+// specFor returns the TypeSpec that governs messages of the given type. If
+// passthrough is true, unregistered types are governed by passthroughSpec.
+func specFor(messageType uint8, passthrough bool) (TypeSpec, bool) {
+	if spec, ok := LookupType(messageType); ok {
+		return spec, true
+	}
+	if passthrough {
+		return passthroughSpec, true
+	}
+	return TypeSpec{}, false
+}
+
+// typeName returns a human-readable name for the message type.
+func typeName(messageType uint8) string {
+	if spec, ok := LookupType(messageType); ok && spec.Name != "" {
+		return spec.Name
+	}
+	return fmt.Sprintf("type %d", messageType)
+}
+
+// passthroughSpec handles messages of unregistered types when passthrough is
+// enabled.
+var passthroughSpec = TypeSpec{
+	Name: "UNKNOWN",
+	Shape: func(m *ProtocolMessage) interface{} {
+		return struct {
+			Root   string   `json:",omitempty"`
+			Recent []string `json:",omitempty"`
+			Type   uint8
+			Major  uint8 `json:",omitempty"`
+			Minor  uint8 `json:",omitempty"`
+			*ChatMessage
+			Target     string            `json:",omitempty"`
+			IDs        []string          `json:",omitempty"`
+			Depth      int               `json:",omitempty"`
+			Since      int64             `json:",omitempty"`
+			Nonce      string            `json:",omitempty"`
+			Code       string            `json:",omitempty"`
+			Text       string            `json:",omitempty"`
+			RetryAfter int64             `json:",omitempty"`
+			Meta       map[string]string `json:",omitempty"`
+		}{Root: m.Root, Recent: m.Recent, Type: m.Type, Major: m.Major, Minor: m.Minor, ChatMessage: m.ChatMessage,
+			Target: m.Target, IDs: m.IDs, Depth: m.Depth, Since: m.Since, Nonce: m.Nonce, Code: m.Code, Text: m.Text,
+			RetryAfter: m.RetryAfter, Meta: m.Meta}
+	},
+	Validate: func(*ProtocolMessage) error { return nil },
+}
+
+func init() {
+	builtins := map[uint8]TypeSpec{
+		WelcomeType: {
+			Name:   "WELCOME",
+			Fields: []string{"Root", "Recent", "Major", "Minor"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				return struct {
+					Root   string
+					Recent []string
+					Type   uint8
+					Major  uint8
+					Minor  uint8
+				}{Type: m.Type, Root: m.Root, Recent: m.Recent, Major: m.Major, Minor: m.Minor}
+			},
+			Validate: (*ProtocolMessage).validateWelcome,
+		},
+		QueryType: {
+			Name:   "QUERY",
+			Fields: []string{"UUID"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				shape := struct {
+					UUID string
+					Type uint8
+				}{Type: m.Type}
+				if m.ChatMessage != nil {
+					shape.UUID = m.UUID
+				}
+				return shape
+			},
+			Validate: (*ProtocolMessage).validateQuery,
+		},
+		NewMessageType: {
+			Name:   "NEW",
+			Fields: []string{"UUID", "Parent", "Content", "Username", "Timestamp"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				return struct {
+					*ChatMessage
+					Type uint8
+				}{ChatMessage: m.ChatMessage, Type: m.Type}
+			},
+			Validate: (*ProtocolMessage).validateNew,
+		},
+		MetaType: {
+			Name:   "META",
+			Fields: []string{"Meta"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				return struct {
+					Meta map[string]string
+					Type uint8
+				}{Type: m.Type, Meta: m.Meta}
+			},
+			Validate: (*ProtocolMessage).validateMeta,
+		},
+		EditType: {
+			Name:   "EDIT",
+			Fields: []string{"Target", "Username", "Content", "Timestamp"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				shape := struct {
+					Target    string
+					Username  string
+					Content   string
+					Timestamp int64
+					Type      uint8
+				}{Target: m.Target, Type: m.Type}
+				if m.ChatMessage != nil {
+					shape.Username, shape.Content, shape.Timestamp = m.Username, m.Content, m.Timestamp
+				}
+				return shape
+			},
+			Validate: (*ProtocolMessage).validateEdit,
+		},
+		DeleteType: {
+			Name:   "DELETE",
+			Fields: []string{"Target", "Username", "Timestamp"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				shape := struct {
+					Target    string
+					Username  string
+					Timestamp int64
+					Type      uint8
+				}{Target: m.Target, Type: m.Type}
+				if m.ChatMessage != nil {
+					shape.Username, shape.Timestamp = m.Username, m.Timestamp
+				}
+				return shape
+			},
+			Validate: (*ProtocolMessage).validateDelete,
+		},
+		BatchQueryType: {
+			Name:   "BATCH_QUERY",
+			Fields: []string{"IDs"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				return struct {
+					IDs  []string
+					Type uint8
+				}{IDs: m.IDs, Type: m.Type}
+			},
+			Validate: (*ProtocolMessage).validateBatchQuery,
+		},
+		AncestorsQueryType: {
+			Name:   "ANCESTORS_QUERY",
+			Fields: []string{"UUID", "Depth"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				shape := struct {
+					UUID  string
+					Depth int
+					Type  uint8
+				}{Depth: m.Depth, Type: m.Type}
+				if m.ChatMessage != nil {
+					shape.UUID = m.UUID
+				}
+				return shape
+			},
+			Validate: (*ProtocolMessage).validateAncestorsQuery,
+		},
+		DescendantsQueryType: {
+			Name:   "DESCENDANTS_QUERY",
+			Fields: []string{"UUID", "Since"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				shape := struct {
+					UUID  string
+					Since int64
+					Type  uint8
+				}{Since: m.Since, Type: m.Type}
+				if m.ChatMessage != nil {
+					shape.UUID = m.UUID
+				}
+				return shape
+			},
+			Validate: (*ProtocolMessage).validateDescendantsQuery,
+		},
+		PingType: {
+			Name:   "PING",
+			Fields: []string{"Nonce"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				return struct {
+					Nonce string
+					Type  uint8
+				}{Nonce: m.Nonce, Type: m.Type}
+			},
+			Validate: (*ProtocolMessage).validatePing,
+		},
+		PongType: {
+			Name:   "PONG",
+			Fields: []string{"Nonce"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				return struct {
+					Nonce string
+					Type  uint8
+				}{Nonce: m.Nonce, Type: m.Type}
+			},
+			Validate: (*ProtocolMessage).validatePong,
+		},
+		ErrorType: {
+			Name:   "ERROR",
+			Fields: []string{"Code", "Text", "Target"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				return struct {
+					Code   string
+					Text   string `json:",omitempty"`
+					Target string `json:",omitempty"`
+					Type   uint8
+				}{Code: m.Code, Text: m.Text, Target: m.Target, Type: m.Type}
+			},
+			Validate: (*ProtocolMessage).validateError,
+		},
+		ByeType: {
+			Name:   "BYE",
+			Fields: []string{"Code", "Text", "RetryAfter"},
+			Shape: func(m *ProtocolMessage) interface{} {
+				return struct {
+					Code       string
+					Text       string `json:",omitempty"`
+					RetryAfter int64  `json:",omitempty"`
+					Type       uint8
+				}{Code: m.Code, Text: m.Text, RetryAfter: m.RetryAfter, Type: m.Type}
+			},
+			Validate: (*ProtocolMessage).validateBye,
+		},
+	}
+	for messageType, spec := range builtins {
+		if err := RegisterType(messageType, spec); err != nil {
+			panic(err)
+		}
+	}
+}
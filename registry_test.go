@@ -0,0 +1,116 @@
+package arbor_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+const (
+	testCustomType      = 200
+	testPassthroughType = 201
+)
+
+// TestRegisterType ensures that applications can add message types with their own
+// serialization and validation rules.
+func TestRegisterType(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	err := arbor.RegisterType(testCustomType, arbor.TypeSpec{
+		Name: "SHOUT",
+		Shape: func(m *arbor.ProtocolMessage) interface{} {
+			return struct {
+				Type    uint8
+				Content string
+			}{Type: m.Type, Content: m.Content}
+		},
+		Validate: func(m *arbor.ProtocolMessage) error {
+			if m.ChatMessage == nil || m.Content == "" {
+				return &arbor.ValidationError{Type: m.Type, Field: "Content", Problem: arbor.FieldMissing}
+			}
+			return nil
+		},
+	})
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	defer arbor.UnregisterType(testCustomType)
+	spec, ok := arbor.LookupType(testCustomType)
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(spec.Name).To(gomega.Equal("SHOUT"))
+
+	shout := &arbor.ProtocolMessage{Type: testCustomType, ChatMessage: &arbor.ChatMessage{Content: "HELLO", Username: testUser}}
+	g.Expect(shout.Validate()).To(gomega.Succeed())
+	g.Expect(marshalOrFail(t, shout)).To(gomega.MatchJSON(`{"Type":200,"Content":"HELLO"}`))
+	shout.Content = ""
+	g.Expect(shout.Validate()).To(gomega.MatchError(gomega.ContainSubstring("SHOUT")))
+
+	// the type can be read like any other
+	reader, err := arbor.NewProtocolReader(bytes.NewBufferString(`{"Type":200,"Content":"HI"}`))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(reader.Read(new(arbor.ProtocolMessage))).To(gomega.Succeed())
+}
+
+// TestRegisterTypeConflict ensures that types cannot be registered twice or without
+// the functions needed to handle them.
+func TestRegisterTypeConflict(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	spec, ok := arbor.LookupType(arbor.NewType)
+	g.Expect(ok).To(gomega.BeTrue())
+	g.Expect(spec.Name).To(gomega.Equal("NEW"))
+	g.Expect(arbor.RegisterType(arbor.NewType, spec)).ToNot(gomega.Succeed())
+	g.Expect(arbor.RegisterType(testCustomType+10, arbor.TypeSpec{Name: "INCOMPLETE"})).ToNot(gomega.Succeed())
+	_, ok = arbor.LookupType(testBadMessageType)
+	g.Expect(ok).To(gomega.BeFalse())
+}
+
+// TestUnknownTypePassthrough ensures that unknown types can be forwarded by readers
+// and writers with passthrough enabled, and only by them.
+func TestUnknownTypePassthrough(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	unknown := &arbor.ProtocolMessage{Type: testPassthroughType, Root: testRoot, Meta: map[string]string{"key": "value"}}
+	g.Expect(unknown.IsValid()).To(gomega.BeFalse())
+	_, err := json.Marshal(unknown)
+	g.Expect(err).To(gomega.HaveOccurred())
+
+	plainWriter, err := arbor.NewProtocolWriter(new(bytes.Buffer))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(plainWriter.Write(unknown)).ToNot(gomega.Succeed())
+
+	buffer := new(bytes.Buffer)
+	writer, err := arbor.NewProtocolWriter(buffer, arbor.WithUnknownTypePassthrough())
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(writer.Write(unknown)).To(gomega.Succeed())
+	g.Expect(buffer.String()).To(gomega.MatchJSON(`{"Type":201,"Root":"root","Meta":{"key":"value"}}`))
+
+	plainReader, err := arbor.NewProtocolReader(bytes.NewReader(buffer.Bytes()))
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	var validationErr *arbor.ValidationError
+	g.Expect(errors.As(plainReader.Read(new(arbor.ProtocolMessage)), &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Problem).To(gomega.Equal(arbor.UnknownType))
+
+	reader, err := arbor.NewProtocolReader(buffer, arbor.WithUnknownTypePassthrough())
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	read := new(arbor.ProtocolMessage)
+	g.Expect(reader.Read(read)).To(gomega.Succeed())
+	g.Expect(read.Equals(unknown)).To(gomega.BeTrue())
+}
+
+// TestUnknownTypePassthroughCodecs ensures that the binary codecs can also forward
+// unknown types.
+func TestUnknownTypePassthroughCodecs(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	unknown := &arbor.ProtocolMessage{Type: testPassthroughType, Root: testRoot, Depth: 3}
+	for _, codec := range []arbor.Codec{arbor.CBORCodec, arbor.MsgPackCodec} {
+		buffer := new(bytes.Buffer)
+		writer, err := arbor.NewProtocolWriter(buffer, arbor.WithCodec(codec), arbor.WithUnknownTypePassthrough())
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		g.Expect(writer.Write(unknown)).To(gomega.Succeed(), codec.Name())
+		reader, err := arbor.NewProtocolReader(buffer, arbor.WithCodec(codec), arbor.WithUnknownTypePassthrough())
+		g.Expect(err).ToNot(gomega.HaveOccurred())
+		read := new(arbor.ProtocolMessage)
+		g.Expect(reader.Read(read)).To(gomega.Succeed(), codec.Name())
+		g.Expect(read.Equals(unknown)).To(gomega.BeTrue(), codec.Name())
+	}
+}
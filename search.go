@@ -0,0 +1,226 @@
+package arbor
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SearchOrder determines the order of the results returned by Store.Search.
+type SearchOrder int
+
+const (
+	// ByRelevance orders search results with the best matches first. Results
+	// that match equally well are ordered newest first.
+	ByRelevance SearchOrder = iota
+	// ByTime orders search results newest first.
+	ByTime
+)
+
+// SearchQuery describes the messages to find with Store.Search. Fields left
+// empty place no restriction on the results.
+type SearchQuery struct {
+	// Text holds the words that must all appear in a message's Content.
+	// Matching ignores case and punctuation. Words enclosed in double quotes
+	// must appear together as a phrase, in the order given.
+	Text string
+	// Username limits the results to messages sent by this user.
+	Username string
+	// Since limits the results to messages with a Timestamp no earlier than this.
+	Since int64
+	// Until limits the results to messages with a Timestamp no later than this.
+	Until int64
+	// Order determines the order of the results.
+	Order SearchOrder
+	// Limit is the largest number of results to return. Zero means no limit.
+	Limit int
+}
+
+// postings maps each word to the messages that contain it and the positions
+// at which it appears within each message.
+type postings map[string]map[string][]int
+
+// tokenize splits text into lowercase words, discarding punctuation.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// parseSearchText splits search text into individual words and quoted phrases.
+func parseSearchText(text string) (terms []string, phrases [][]string) {
+	for i, part := range strings.Split(text, "\"") {
+		words := tokenize(part)
+		if i%2 == 0 {
+			terms = append(terms, words...)
+		} else if len(words) > 0 {
+			phrases = append(phrases, words)
+		}
+	}
+	return terms, phrases
+}
+
+// index adds msg's words to the search index. It must only be called from the
+// dispatch goroutine.
+func (s *Store) index(msg *ChatMessage) {
+	for position, word := range tokenize(msg.Content) {
+		if s.words[word] == nil {
+			s.words[word] = make(map[string][]int)
+		}
+		s.words[word][msg.UUID] = append(s.words[word][msg.UUID], position)
+	}
+}
+
+// unindex removes msg's words from the search index. It must only be called
+// from the dispatch goroutine.
+func (s *Store) unindex(msg *ChatMessage) {
+	for _, word := range tokenize(msg.Content) {
+		delete(s.words[word], msg.UUID)
+		if len(s.words[word]) == 0 {
+			delete(s.words, word)
+		}
+	}
+}
+
+// Search returns the messages in the store that match the query. It returns
+// nil if the Store has been closed.
+func (s *Store) Search(query SearchQuery) []*ChatMessage {
+	var results []*ChatMessage
+	_ = s.doContext(context.Background(), func() {
+		results = s.search(query)
+	})
+	return results
+}
+
+// search implements Search. It must only be called from the dispatch
+// goroutine.
+func (s *Store) search(query SearchQuery) []*ChatMessage {
+	terms, phrases := parseSearchText(query.Text)
+	words := append([]string{}, terms...)
+	for _, phrase := range phrases {
+		words = append(words, phrase...)
+	}
+	scores := map[string]float64{}
+	for _, msg := range s.candidates(words) {
+		if !query.admits(msg) || !s.containsPhrases(msg.UUID, phrases) {
+			continue
+		}
+		scores[msg.UUID] = s.relevance(msg.UUID, words)
+	}
+	results := make([]*ChatMessage, 0, len(scores))
+	for id := range scores {
+		results = append(results, s.m[id])
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if query.Order == ByRelevance && scores[a.UUID] != scores[b.UUID] {
+			return scores[a.UUID] > scores[b.UUID]
+		}
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp > b.Timestamp
+		}
+		return s.added[a.UUID] > s.added[b.UUID]
+	})
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	return results
+}
+
+// admits reports whether msg satisfies the query's username and time filters.
+func (q SearchQuery) admits(msg *ChatMessage) bool {
+	switch {
+	case q.Username != "" && q.Username != msg.Username:
+		return false
+	case q.Since != 0 && msg.Timestamp < q.Since:
+		return false
+	case q.Until != 0 && msg.Timestamp > q.Until:
+		return false
+	}
+	return true
+}
+
+// candidates returns the messages that contain every one of the words, or
+// every message if there are no words. It must only be called from the
+// dispatch goroutine.
+func (s *Store) candidates(words []string) []*ChatMessage {
+	var candidates []*ChatMessage
+	if len(words) == 0 {
+		for _, msg := range s.m {
+			candidates = append(candidates, msg)
+		}
+		return candidates
+	}
+	// start from the rarest word to examine as few messages as possible
+	rarest := words[0]
+	for _, word := range words[1:] {
+		if len(s.words[word]) < len(s.words[rarest]) {
+			rarest = word
+		}
+	}
+	for id := range s.words[rarest] {
+		found := true
+		for _, word := range words {
+			if _, ok := s.words[word][id]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			candidates = append(candidates, s.m[id])
+		}
+	}
+	return candidates
+}
+
+// containsPhrases reports whether the message with the given id contains each
+// phrase as a sequence of consecutive words. It must only be called from the
+// dispatch goroutine.
+func (s *Store) containsPhrases(id string, phrases [][]string) bool {
+	for _, phrase := range phrases {
+		found := false
+		for _, start := range s.words[phrase[0]][id] {
+			if s.phraseAt(id, phrase, start) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// phraseAt reports whether the phrase begins at the given word position in
+// the message with the given id.
+func (s *Store) phraseAt(id string, phrase []string, start int) bool {
+	for offset, word := range phrase[1:] {
+		found := false
+		for _, position := range s.words[word][id] {
+			if position == start+offset+1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// relevance scores how well the message with the given id matches the words,
+// favoring words that appear often in the message but rarely in the store.
+// It must only be called from the dispatch goroutine.
+func (s *Store) relevance(id string, words []string) float64 {
+	var score float64
+	for _, word := range words {
+		frequency := float64(len(s.words[word][id]))
+		rarity := math.Log(1 + float64(len(s.m))/float64(len(s.words[word])))
+		score += frequency * rarity
+	}
+	return score
+}
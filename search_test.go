@@ -0,0 +1,68 @@
+package arbor_test
+
+import (
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// searchStore creates a store containing a few messages to search.
+func searchStore() *arbor.Store {
+	s := arbor.NewStore()
+	for _, msg := range []*arbor.ChatMessage{
+		{UUID: "1", Username: "alice", Timestamp: 100, Content: "The quick brown fox"},
+		{UUID: "2", Username: "bob", Timestamp: 200, Content: "A fox, a fox! My kingdom for a FOX."},
+		{UUID: "3", Username: "alice", Timestamp: 300, Content: "Brown bread is quick to make"},
+		{UUID: "4", Username: "carol", Timestamp: 400, Content: "Nothing to see here"},
+	} {
+		s.Add(msg)
+	}
+	return s
+}
+
+// TestSearchTerms ensures that searching for words finds messages containing all of
+// them, regardless of case and punctuation.
+func TestSearchTerms(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := searchStore()
+	defer s.Close()
+	g.Expect(ids(s.Search(arbor.SearchQuery{Text: "fox"}))).To(gomega.Equal([]string{"2", "1"}))
+	g.Expect(ids(s.Search(arbor.SearchQuery{Text: "QUICK brown"}))).To(gomega.ConsistOf("1", "3"))
+	g.Expect(s.Search(arbor.SearchQuery{Text: "fox bread"})).To(gomega.BeEmpty())
+	g.Expect(s.Search(arbor.SearchQuery{Text: "unicorn"})).To(gomega.BeEmpty())
+}
+
+// TestSearchPhrase ensures that quoted phrases only match consecutive words.
+func TestSearchPhrase(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := searchStore()
+	defer s.Close()
+	g.Expect(ids(s.Search(arbor.SearchQuery{Text: `"quick brown"`}))).To(gomega.Equal([]string{"1"}))
+	g.Expect(ids(s.Search(arbor.SearchQuery{Text: `"brown quick"`}))).To(gomega.BeEmpty())
+	g.Expect(ids(s.Search(arbor.SearchQuery{Text: `bread "is quick"`}))).To(gomega.Equal([]string{"3"}))
+}
+
+// TestSearchFilters ensures that the username and time range restrict results and
+// that results can be ordered by time.
+func TestSearchFilters(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := searchStore()
+	defer s.Close()
+	g.Expect(ids(s.Search(arbor.SearchQuery{Username: "alice", Order: arbor.ByTime}))).To(gomega.Equal([]string{"3", "1"}))
+	g.Expect(ids(s.Search(arbor.SearchQuery{Since: 200, Until: 300, Order: arbor.ByTime}))).To(gomega.Equal([]string{"3", "2"}))
+	g.Expect(ids(s.Search(arbor.SearchQuery{Text: "quick", Username: "alice", Since: 200}))).To(gomega.Equal([]string{"3"}))
+	g.Expect(s.Search(arbor.SearchQuery{Order: arbor.ByTime, Limit: 2})).To(gomega.HaveLen(2))
+}
+
+// TestSearchUpdates ensures that the index follows replacements and deletions.
+func TestSearchUpdates(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := searchStore()
+	defer s.Close()
+	s.Add(&arbor.ChatMessage{UUID: "1", Username: "alice", Timestamp: 100, Content: "The slow grey wolf"})
+	g.Expect(ids(s.Search(arbor.SearchQuery{Text: "fox"}))).To(gomega.Equal([]string{"2"}))
+	g.Expect(ids(s.Search(arbor.SearchQuery{Text: "wolf"}))).To(gomega.Equal([]string{"1"}))
+	s.Delete("2")
+	g.Expect(s.Search(arbor.SearchQuery{Text: "fox"})).To(gomega.BeEmpty())
+}
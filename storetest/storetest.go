@@ -0,0 +1,287 @@
+// Package storetest provides a conformance test suite for implementations of
+// arbor.MessageStore.
+//
+// Authors of new MessageStore backends can verify their implementation from
+// an ordinary test function:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) arbor.MessageStore {
+//			return NewMyStore()
+//		})
+//	}
+package storetest
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+)
+
+// Factory creates a new, empty MessageStore for use by a single test. If the
+// returned store implements io.Closer, it will be closed when the test ends.
+type Factory func(t *testing.T) arbor.MessageStore
+
+// Run exercises the MessageStore implementation created by factory, reporting
+// any deviation from the behavior documented on arbor.MessageStore as a test
+// failure. If the implementation also satisfies arbor.TreeStore, the
+// tree-related methods are verified as well.
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, arbor.MessageStore)
+	}{
+		{"AddAndGet", testAddAndGet},
+		{"GetMissing", testGetMissing},
+		{"Replace", testReplace},
+		{"Delete", testDelete},
+		{"Range", testRange},
+		{"Concurrent", testConcurrent},
+		{"TreeInvariants", testTreeInvariants},
+	}
+	for _, tc := range tests {
+		test := tc.test
+		t.Run(tc.name, func(t *testing.T) {
+			store := factory(t)
+			if store == nil {
+				t.Fatal("Factory returned nil store")
+			}
+			if closer, ok := store.(io.Closer); ok {
+				defer func() {
+					if err := closer.Close(); err != nil {
+						t.Error("Unable to close store", err)
+					}
+				}()
+			}
+			test(t, store)
+		})
+	}
+}
+
+// message creates a distinct message with the given id and parent.
+func message(id, parent string) *arbor.ChatMessage {
+	return &arbor.ChatMessage{
+		UUID:      id,
+		Parent:    parent,
+		Content:   "content of " + id,
+		Username:  "storetest",
+		Timestamp: 1537738224,
+	}
+}
+
+func testAddAndGet(t *testing.T, s arbor.MessageStore) {
+	const count = 100
+	for i := 0; i < count; i++ {
+		s.Add(message(strconv.Itoa(i), ""))
+	}
+	for i := 0; i < count; i++ {
+		expected := message(strconv.Itoa(i), "")
+		if found := s.Get(expected.UUID); !found.Equals(expected) {
+			t.Errorf("Expected %v, found %v", expected, found)
+		}
+		if !s.Has(expected.UUID) {
+			t.Errorf("Has(%s) returned false for stored message", expected.UUID)
+		}
+	}
+}
+
+func testGetMissing(t *testing.T, s arbor.MessageStore) {
+	if found := s.Get("missing"); found != nil {
+		t.Error("Get returned non-nil message for missing id", found)
+	}
+	if s.Has("missing") {
+		t.Error("Has returned true for missing id")
+	}
+	// deleting a missing message must not fail or panic
+	s.Delete("missing")
+}
+
+func testReplace(t *testing.T, s arbor.MessageStore) {
+	original := message("id", "")
+	s.Add(original)
+	replacement := message("id", "")
+	replacement.Content = "replaced"
+	s.Add(replacement)
+	if found := s.Get("id"); !found.Equals(replacement) {
+		t.Errorf("Expected %v after replacement, found %v", replacement, found)
+	}
+	count := 0
+	s.Range(func(*arbor.ChatMessage) bool {
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Errorf("Expected 1 message after replacement, found %d", count)
+	}
+}
+
+func testDelete(t *testing.T, s arbor.MessageStore) {
+	s.Add(message("parent", ""))
+	s.Add(message("child", "parent"))
+	s.Delete("parent")
+	if s.Has("parent") || s.Get("parent") != nil {
+		t.Error("Deleted message still present")
+	}
+	if !s.Get("child").Equals(message("child", "parent")) {
+		t.Error("Deleting a message altered its reply")
+	}
+	s.Add(message("parent", ""))
+	if !s.Has("parent") {
+		t.Error("Unable to add message again after deleting it")
+	}
+}
+
+func testRange(t *testing.T, s arbor.MessageStore) {
+	expected := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		id := strconv.Itoa(i)
+		expected[id] = true
+		s.Add(message(id, ""))
+	}
+	seen := map[string]bool{}
+	s.Range(func(m *arbor.ChatMessage) bool {
+		if seen[m.UUID] {
+			t.Errorf("Range visited %s more than once", m.UUID)
+		}
+		seen[m.UUID] = true
+		// calling back into the store must be safe
+		if !s.Has(m.UUID) {
+			t.Errorf("Range visited %s, which is not in the store", m.UUID)
+		}
+		return true
+	})
+	if len(seen) != len(expected) {
+		t.Errorf("Range visited %d messages, expected %d", len(seen), len(expected))
+	}
+	visits := 0
+	s.Range(func(*arbor.ChatMessage) bool {
+		visits++
+		return false
+	})
+	if visits != 1 {
+		t.Errorf("Range continued after callback returned false (%d visits)", visits)
+	}
+}
+
+func testConcurrent(t *testing.T, s arbor.MessageStore) {
+	const workers, perWorker = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				id := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				s.Add(message(id, ""))
+				if !s.Has(id) || s.Get(id) == nil {
+					t.Errorf("Message %s missing immediately after Add", id)
+				}
+				s.Range(func(*arbor.ChatMessage) bool { return false })
+			}
+		}(w)
+	}
+	wg.Wait()
+	count := 0
+	s.Range(func(*arbor.ChatMessage) bool {
+		count++
+		return true
+	})
+	if count != workers*perWorker {
+		t.Errorf("Expected %d messages after concurrent adds, found %d", workers*perWorker, count)
+	}
+}
+
+// tree is the shape of the conversation used by testTreeInvariants, as a
+// list of (id, parent) pairs. The reply "d" is deliberately added before
+// its parent "c".
+var tree = [][2]string{
+	{"root", ""},
+	{"a", "root"},
+	{"b", "root"},
+	{"d", "c"},
+	{"c", "a"},
+	{"e", "d"},
+}
+
+func testTreeInvariants(t *testing.T, s arbor.MessageStore) {
+	for _, pair := range tree {
+		s.Add(message(pair[0], pair[1]))
+	}
+	for _, pair := range tree {
+		if found := s.Get(pair[0]); found == nil || found.Parent != pair[1] {
+			t.Errorf("Expected %s to have parent %q, found %v", pair[0], pair[1], found)
+		}
+	}
+	ts, ok := s.(arbor.TreeStore)
+	if !ok {
+		return
+	}
+	checkTree(t, ts)
+	// removing an interior message must not orphan the index of its replies
+	ts.Delete("c")
+	if children := ts.Children("c"); len(children) != 1 || children[0].UUID != "d" {
+		t.Errorf("Expected replies to deleted message to remain indexed, found %v", children)
+	}
+	checkTree(t, ts)
+}
+
+// checkTree verifies that the tree queries on s agree with the Parent fields
+// of the messages that it holds.
+func checkTree(t *testing.T, s arbor.TreeStore) {
+	all := map[string]*arbor.ChatMessage{}
+	s.Range(func(m *arbor.ChatMessage) bool {
+		all[m.UUID] = m
+		return true
+	})
+	hasChildren := map[string]bool{}
+	for id, m := range all {
+		hasChildren[m.Parent] = true
+		found := false
+		for _, sibling := range s.Children(m.Parent) {
+			if sibling.UUID == id {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Message %s missing from Children(%q)", id, m.Parent)
+		}
+		for _, child := range s.Children(id) {
+			if child.Parent != id {
+				t.Errorf("Children(%s) returned %s, whose parent is %s", id, child.UUID, child.Parent)
+			}
+		}
+		previous := m
+		for _, ancestor := range s.Ancestors(id) {
+			if ancestor.UUID != previous.Parent {
+				t.Errorf("Ancestors(%s) skipped from %s to %s", id, previous.UUID, ancestor.UUID)
+			}
+			previous = ancestor
+		}
+		if _, ok := all[previous.Parent]; ok {
+			t.Errorf("Ancestors(%s) stopped at %s although its parent is present", id, previous.UUID)
+		}
+		subtree := s.Subtree(id, -1)
+		if len(subtree) == 0 || subtree[0].UUID != id {
+			t.Errorf("Subtree(%s) does not begin with the message itself", id)
+			continue
+		}
+		for _, descendant := range subtree[1:] {
+			if _, ok := all[descendant.Parent]; !ok {
+				t.Errorf("Subtree(%s) contains %s, whose parent is missing", id, descendant.UUID)
+			}
+		}
+	}
+	for _, leaf := range s.Leaves() {
+		if hasChildren[leaf.UUID] {
+			t.Errorf("Leaves returned %s, which has replies", leaf.UUID)
+		}
+		delete(all, leaf.UUID)
+	}
+	for id := range all {
+		if !hasChildren[id] {
+			t.Errorf("Leaves did not return %s, which has no replies", id)
+		}
+	}
+}
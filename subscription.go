@@ -0,0 +1,142 @@
+package arbor
+
+import (
+	"context"
+	"sync"
+)
+
+// SubscriptionFilter restricts the messages delivered to a Subscription. Fields
+// left empty match every message.
+type SubscriptionFilter struct {
+	// Subtree limits delivery to the message with this UUID and its descendants.
+	// Descendants are only recognized if the chain of parents connecting them
+	// to this message is present in the Store when they are added.
+	Subtree string
+	// Username limits delivery to messages sent by this user.
+	Username string
+}
+
+// Subscription delivers messages to its owner as they are added to a Store.
+// Messages are queued for the subscriber without limit, so a slow subscriber
+// never delays the Store. Call Unsubscribe when the Subscription is no
+// longer needed.
+type Subscription struct {
+	// C receives each matching message added to the Store, in the order in
+	// which they were added. When a message is edited or deleted with Apply,
+	// its new version or tombstone is received as well. It is closed when the Subscription ends because
+	// of a call to Unsubscribe or because the Store was closed.
+	C      <-chan *ChatMessage
+	in     chan *ChatMessage
+	filter SubscriptionFilter
+	store  *Store
+	once   sync.Once
+}
+
+// Subscribe registers a new Subscription for messages added to the Store
+// that match the filter. It returns ErrStoreClosed if the Store has been
+// closed.
+func (s *Store) Subscribe(filter SubscriptionFilter) (*Subscription, error) {
+	out := make(chan *ChatMessage)
+	sub := &Subscription{
+		C:      out,
+		in:     make(chan *ChatMessage),
+		filter: filter,
+		store:  s,
+	}
+	go sub.forward(out)
+	if err := s.doContext(context.Background(), func() {
+		s.subscriptions[sub] = struct{}{}
+	}); err != nil {
+		sub.stop()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Unsubscribe ends the Subscription. Any messages that have not yet been
+// received from C are discarded and C is closed. It is safe to call
+// Unsubscribe more than once.
+func (sub *Subscription) Unsubscribe() {
+	sub.store.do(func() {
+		delete(sub.store.subscriptions, sub)
+	})
+	sub.stop()
+}
+
+// stop ends delivery to the subscriber.
+func (sub *Subscription) stop() {
+	sub.once.Do(func() {
+		close(sub.in)
+	})
+}
+
+// forward queues messages received from the Store until the subscriber is
+// ready to receive them.
+func (sub *Subscription) forward(out chan<- *ChatMessage) {
+	defer close(out)
+	var queue []*ChatMessage
+	for {
+		var next *ChatMessage
+		var send chan<- *ChatMessage
+		if len(queue) > 0 {
+			next = queue[0]
+			send = out
+		}
+		select {
+		case msg, ok := <-sub.in:
+			if !ok {
+				return
+			}
+			queue = append(queue, msg)
+		case send <- next:
+			queue[0] = nil
+			queue = queue[1:]
+		}
+	}
+}
+
+// notify delivers msg to each subscription whose filter it matches. It must
+// only be called from the dispatch goroutine.
+func (s *Store) notify(msg *ChatMessage) {
+	for sub := range s.subscriptions {
+		if s.matches(sub.filter, msg) {
+			sub.in <- msg
+		}
+	}
+}
+
+// matches reports whether msg satisfies the filter. It must only be called
+// from the dispatch goroutine.
+func (s *Store) matches(filter SubscriptionFilter, msg *ChatMessage) bool {
+	if filter.Username != "" && filter.Username != msg.Username {
+		return false
+	}
+	if filter.Subtree == "" || filter.Subtree == msg.UUID {
+		return true
+	}
+	visited := map[string]struct{}{msg.UUID: {}}
+	for current := msg; current.Parent != ""; {
+		if current.Parent == filter.Subtree {
+			return true
+		}
+		if _, seen := visited[current.Parent]; seen {
+			return false
+		}
+		visited[current.Parent] = struct{}{}
+		parent, ok := s.m[current.Parent]
+		if !ok {
+			return false
+		}
+		current = parent
+	}
+	return false
+}
+
+// endSubscriptions stops every subscription. It must only be called from the
+// dispatch goroutine.
+func (s *Store) endSubscriptions() {
+	for sub := range s.subscriptions {
+		sub.stop()
+		delete(s.subscriptions, sub)
+	}
+}
@@ -0,0 +1,75 @@
+package arbor_test
+
+import (
+	"testing"
+	"time"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+func subscribeOrFail(t *testing.T, s *arbor.Store, filter arbor.SubscriptionFilter) *arbor.Subscription {
+	sub, err := s.Subscribe(filter)
+	if err != nil {
+		t.Fatal("Unable to subscribe", err)
+	}
+	return sub
+}
+
+// TestSubscribe ensures that subscribers receive every message added after they
+// subscribe, in order, even if they do not receive them right away.
+func TestSubscribe(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	sub := subscribeOrFail(t, s, arbor.SubscriptionFilter{})
+	defer sub.Unsubscribe()
+	// nobody is receiving from the subscription, but adds must not block
+	msgs := make([]*arbor.ChatMessage, 100)
+	for i := range msgs {
+		msgs[i] = randomMessage()
+		s.Add(msgs[i])
+	}
+	for _, msg := range msgs {
+		g.Eventually(sub.C).Should(gomega.Receive(gomega.Equal(msg)))
+	}
+}
+
+// TestSubscribeFilter ensures that subscriptions only deliver messages matching their
+// filters.
+func TestSubscribeFilter(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	defer s.Close()
+	bySubtree := subscribeOrFail(t, s, arbor.SubscriptionFilter{Subtree: "a"})
+	byUser := subscribeOrFail(t, s, arbor.SubscriptionFilter{Username: "alice"})
+	buildTree(s)
+	s.Add(&arbor.ChatMessage{UUID: "e", Parent: "c", Username: "alice"})
+
+	for _, id := range []string{"a", "c", "d", "e"} {
+		g.Eventually(bySubtree.C).Should(gomega.Receive(gomega.Equal(s.Get(id))))
+	}
+	g.Consistently(bySubtree.C, 50*time.Millisecond).ShouldNot(gomega.Receive())
+	g.Eventually(byUser.C).Should(gomega.Receive(gomega.Equal(s.Get("e"))))
+	g.Consistently(byUser.C, 50*time.Millisecond).ShouldNot(gomega.Receive())
+}
+
+// TestUnsubscribe ensures that unsubscribing and closing the store close the
+// subscription's channel.
+func TestUnsubscribe(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	s := arbor.NewStore()
+	sub := subscribeOrFail(t, s, arbor.SubscriptionFilter{})
+	s.Add(randomMessage())
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	g.Eventually(sub.C).Should(gomega.BeClosed())
+	s.Add(randomMessage())
+
+	other := subscribeOrFail(t, s, arbor.SubscriptionFilter{})
+	g.Expect(s.Close()).To(gomega.Succeed())
+	g.Eventually(other.C).Should(gomega.BeClosed())
+	other.Unsubscribe()
+	_, err := s.Subscribe(arbor.SubscriptionFilter{})
+	g.Expect(err).To(gomega.Equal(arbor.ErrStoreClosed))
+}
@@ -0,0 +1,284 @@
+package arbor
+
+import "fmt"
+
+// ValidationProblem identifies the kind of mistake that makes a ProtocolMessage
+// invalid.
+type ValidationProblem int
+
+const (
+	// FieldMissing means that a field required by the message's type is empty.
+	FieldMissing ValidationProblem = iota
+	// FieldUnexpected means that a field not used by the message's type is set.
+	FieldUnexpected
+	// WrongType means that the message was checked against the rules for a
+	// different type than its own.
+	WrongType
+	// UnknownType means that the message's Type is not a recognized message type.
+	UnknownType
+	// FieldInvalid means that a field holds a value that is not allowed.
+	FieldInvalid
+)
+
+// String returns a short description of the problem.
+func (p ValidationProblem) String() string {
+	switch p {
+	case FieldMissing:
+		return "missing"
+	case FieldUnexpected:
+		return "unexpected"
+	case WrongType:
+		return "wrong type"
+	case UnknownType:
+		return "unknown type"
+	case FieldInvalid:
+		return "invalid"
+	default:
+		return fmt.Sprintf("ValidationProblem(%d)", int(p))
+	}
+}
+
+// ValidationError explains why a ProtocolMessage is invalid. Retrieve it from
+// the errors returned by this package with errors.As.
+type ValidationError struct {
+	// Type is the Type of the invalid message.
+	Type uint8
+	// Field is the name of the ProtocolMessage field at fault. It is empty for
+	// problems with the message as a whole.
+	Field string
+	// Problem is the kind of mistake found.
+	Problem ValidationProblem
+}
+
+// Error describes the problem with the message.
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("Invalid %s message: %v", typeName(e.Type), e.Problem)
+	}
+	return fmt.Sprintf("Invalid %s message: %v field %s", typeName(e.Type), e.Problem, e.Field)
+}
+
+// invalid creates a ValidationError for the message.
+func (m *ProtocolMessage) invalid(field string, problem ValidationProblem) error {
+	return &ValidationError{Type: m.Type, Field: field, Problem: problem}
+}
+
+// Validate returns nil if the message has the minimum correct fields for its
+// message type. Otherwise it returns a *ValidationError describing the first
+// problem found. Each type's rules are provided by its TypeSpec.
+func (m *ProtocolMessage) Validate() error {
+	return m.validate(false)
+}
+
+// validate is like Validate, but messages of unregistered types are valid if
+// passthrough is true.
+func (m *ProtocolMessage) validate(passthrough bool) error {
+	spec, ok := specFor(m.Type, passthrough)
+	if !ok {
+		return m.invalid("", UnknownType)
+	}
+	return spec.Validate(m)
+}
+
+func (m *ProtocolMessage) validateWelcome() error {
+	switch {
+	case m.Type != WelcomeType:
+		return m.invalid("Type", WrongType)
+	case m.Major == 0 && m.Minor == 0:
+		return m.invalid("Major", FieldMissing)
+	case m.Recent == nil:
+		return m.invalid("Recent", FieldMissing)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	case m.Root == "":
+		return m.invalid("Root", FieldMissing)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validateNew() error {
+	switch {
+	case m.Type != NewMessageType:
+		return m.invalid("Type", WrongType)
+	case m.ChatMessage == nil:
+		return m.invalid("ChatMessage", FieldMissing)
+	case m.Username == "":
+		return m.invalid("Username", FieldMissing)
+	case m.Content == "":
+		return m.invalid("Content", FieldMissing)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	case m.Timestamp == 0:
+		return m.invalid("Timestamp", FieldMissing)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validateQuery() error {
+	switch {
+	case m.Type != QueryType:
+		return m.invalid("Type", WrongType)
+	case m.ChatMessage == nil:
+		return m.invalid("UUID", FieldMissing)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	case m.UUID == "":
+		return m.invalid("UUID", FieldMissing)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validateMeta() error {
+	switch {
+	case m.Type != MetaType:
+		return m.invalid("Type", WrongType)
+	case m.Meta == nil:
+		return m.invalid("Meta", FieldMissing)
+	case m.ChatMessage != nil:
+		return m.invalid("ChatMessage", FieldUnexpected)
+	case m.Major != 0:
+		return m.invalid("Major", FieldUnexpected)
+	case m.Minor != 0:
+		return m.invalid("Minor", FieldUnexpected)
+	case m.Root != "":
+		return m.invalid("Root", FieldUnexpected)
+	case m.Recent != nil:
+		return m.invalid("Recent", FieldUnexpected)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validateEdit() error {
+	switch {
+	case m.Type != EditType:
+		return m.invalid("Type", WrongType)
+	case m.Target == "":
+		return m.invalid("Target", FieldMissing)
+	case m.ChatMessage == nil:
+		return m.invalid("ChatMessage", FieldMissing)
+	case m.Username == "":
+		return m.invalid("Username", FieldMissing)
+	case m.Content == "":
+		return m.invalid("Content", FieldMissing)
+	case m.Timestamp == 0:
+		return m.invalid("Timestamp", FieldMissing)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validateDelete() error {
+	switch {
+	case m.Type != DeleteType:
+		return m.invalid("Type", WrongType)
+	case m.Target == "":
+		return m.invalid("Target", FieldMissing)
+	case m.ChatMessage == nil:
+		return m.invalid("ChatMessage", FieldMissing)
+	case m.Username == "":
+		return m.invalid("Username", FieldMissing)
+	case m.Content != "":
+		return m.invalid("Content", FieldUnexpected)
+	case m.Timestamp == 0:
+		return m.invalid("Timestamp", FieldMissing)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validateBatchQuery() error {
+	switch {
+	case m.Type != BatchQueryType:
+		return m.invalid("Type", WrongType)
+	case len(m.IDs) == 0:
+		return m.invalid("IDs", FieldMissing)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validateAncestorsQuery() error {
+	switch {
+	case m.Type != AncestorsQueryType:
+		return m.invalid("Type", WrongType)
+	case m.ChatMessage == nil || m.UUID == "":
+		return m.invalid("UUID", FieldMissing)
+	case m.Depth < 0:
+		return m.invalid("Depth", FieldInvalid)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validateDescendantsQuery() error {
+	switch {
+	case m.Type != DescendantsQueryType:
+		return m.invalid("Type", WrongType)
+	case m.ChatMessage == nil || m.UUID == "":
+		return m.invalid("UUID", FieldMissing)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validatePing() error {
+	if m.Type != PingType {
+		return m.invalid("Type", WrongType)
+	}
+	return m.validateHeartbeat()
+}
+
+func (m *ProtocolMessage) validatePong() error {
+	if m.Type != PongType {
+		return m.invalid("Type", WrongType)
+	}
+	return m.validateHeartbeat()
+}
+
+// validateHeartbeat checks the fields shared by PING and PONG messages.
+func (m *ProtocolMessage) validateHeartbeat() error {
+	switch {
+	case m.Nonce == "":
+		return m.invalid("Nonce", FieldMissing)
+	case m.ChatMessage != nil:
+		return m.invalid("ChatMessage", FieldUnexpected)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validateError() error {
+	switch {
+	case m.Type != ErrorType:
+		return m.invalid("Type", WrongType)
+	case m.Code == "":
+		return m.invalid("Code", FieldMissing)
+	case m.ChatMessage != nil:
+		return m.invalid("ChatMessage", FieldUnexpected)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	}
+	return nil
+}
+
+func (m *ProtocolMessage) validateBye() error {
+	switch {
+	case m.Type != ByeType:
+		return m.invalid("Type", WrongType)
+	case m.Code == "":
+		return m.invalid("Code", FieldMissing)
+	case m.RetryAfter < 0:
+		return m.invalid("RetryAfter", FieldInvalid)
+	case m.ChatMessage != nil:
+		return m.invalid("ChatMessage", FieldUnexpected)
+	case m.Meta != nil && len(m.Meta) != 0:
+		return m.invalid("Meta", FieldUnexpected)
+	}
+	return nil
+}
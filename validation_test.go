@@ -0,0 +1,70 @@
+package arbor_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// TestValidate ensures that Validate identifies the field responsible for a message
+// being invalid.
+func TestValidate(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	for _, valid := range []*arbor.ProtocolMessage{getWelcome(), getNew(), getQuery(), getMeta()} {
+		g.Expect(valid.Validate()).To(gomega.Succeed())
+	}
+	cases := []struct {
+		name    string
+		modify  func(*arbor.ProtocolMessage)
+		base    func() *arbor.ProtocolMessage
+		field   string
+		problem arbor.ValidationProblem
+	}{
+		{"welcome without root", func(m *arbor.ProtocolMessage) { m.Root = "" }, getWelcome, "Root", arbor.FieldMissing},
+		{"welcome without recent", func(m *arbor.ProtocolMessage) { m.Recent = nil }, getWelcome, "Recent", arbor.FieldMissing},
+		{"welcome without version", func(m *arbor.ProtocolMessage) { m.Minor = 0 }, getWelcome, "Major", arbor.FieldMissing},
+		{"welcome with meta", func(m *arbor.ProtocolMessage) { m.Meta = map[string]string{"a": "b"} }, getWelcome, "Meta", arbor.FieldUnexpected},
+		{"new without username", func(m *arbor.ProtocolMessage) { m.Username = "" }, getNew, "Username", arbor.FieldMissing},
+		{"new without content", func(m *arbor.ProtocolMessage) { m.Content = "" }, getNew, "Content", arbor.FieldMissing},
+		{"new without timestamp", func(m *arbor.ProtocolMessage) { m.Timestamp = 0 }, getNew, "Timestamp", arbor.FieldMissing},
+		{"new without message", func(m *arbor.ProtocolMessage) { m.ChatMessage = nil }, getNew, "ChatMessage", arbor.FieldMissing},
+		{"new with meta", func(m *arbor.ProtocolMessage) { m.Meta = map[string]string{"a": "b"} }, getNew, "Meta", arbor.FieldUnexpected},
+		{"query without uuid", func(m *arbor.ProtocolMessage) { m.UUID = "" }, getQuery, "UUID", arbor.FieldMissing},
+		{"meta without meta", func(m *arbor.ProtocolMessage) { m.Meta = nil }, getMeta, "Meta", arbor.FieldMissing},
+		{"meta with root", func(m *arbor.ProtocolMessage) { m.Root = testRoot }, getMeta, "Root", arbor.FieldUnexpected},
+		{"unknown type", func(m *arbor.ProtocolMessage) {}, getInvalid, "", arbor.UnknownType},
+	}
+	for _, c := range cases {
+		m := c.base()
+		c.modify(m)
+		err := m.Validate()
+		var validationErr *arbor.ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("%s: expected *ValidationError, got %v", c.name, err)
+			continue
+		}
+		if validationErr.Field != c.field || validationErr.Problem != c.problem || validationErr.Type != m.Type {
+			t.Errorf("%s: expected %s %v, got %v", c.name, c.field, c.problem, validationErr)
+		}
+		if m.IsValid() {
+			t.Errorf("%s: IsValid disagrees with Validate", c.name)
+		}
+	}
+}
+
+// TestReaderValidationError ensures that ProtocolReader reports why a message it read
+// was invalid.
+func TestReaderValidationError(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	reader, err := arbor.NewProtocolReader(bytes.NewBufferString(`{"Type":2,"UUID":"id","Content":"hi","Timestamp":1}`))
+	if err != nil {
+		t.Skip("Unable to construct Reader", err)
+	}
+	err = reader.Read(new(arbor.ProtocolMessage))
+	var validationErr *arbor.ValidationError
+	g.Expect(errors.As(err, &validationErr)).To(gomega.BeTrue())
+	g.Expect(validationErr.Field).To(gomega.Equal("Username"))
+}
@@ -0,0 +1,114 @@
+package arbor
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MinSupportedMinor is the oldest minor version of protocol version
+// ProtocolMajor that this package can communicate with. Peers using any other
+// major version are incompatible.
+const MinSupportedMinor = 1
+
+// Version identifies a version of the Arbor protocol.
+type Version struct {
+	Major uint8
+	Minor uint8
+}
+
+// String returns the version in "major.minor" form.
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// VersionError reports that a peer uses a protocol version that this package
+// cannot communicate with.
+type VersionError struct {
+	// Peer is the version advertised by the peer.
+	Peer Version
+}
+
+// Error describes the incompatibility.
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("Peer protocol version %v is incompatible with supported versions %d.%d through %d.%d",
+		e.Peer, ProtocolMajor, MinSupportedMinor, ProtocolMajor, ProtocolMinor)
+}
+
+// NegotiateVersion determines the protocol version to use with a peer that
+// advertises the given version. Peers with a different major version or a
+// minor version older than MinSupportedMinor are rejected with a
+// *VersionError. Otherwise the result is the older of the peer's version and
+// the version implemented by this package.
+func NegotiateVersion(major, minor uint8) (Version, error) {
+	peer := Version{Major: major, Minor: minor}
+	if major != ProtocolMajor || minor < MinSupportedMinor {
+		return Version{}, &VersionError{Peer: peer}
+	}
+	if minor > ProtocolMinor {
+		minor = ProtocolMinor
+	}
+	return Version{Major: major, Minor: minor}, nil
+}
+
+// negotiation records the outcome of a ProtocolReadWriter's handshake.
+type negotiation struct {
+	sync.Mutex
+	version Version
+	done    bool
+}
+
+// ServerHandshake begins a connection from the server side by sending the
+// provided WELCOME message to the client. The version advertised in the
+// WELCOME, limited by NegotiateVersion to the versions that this package
+// supports, becomes the connection's negotiated version. If this package does
+// not support the advertised version, the error is a *VersionError and
+// nothing is sent.
+func (c *ProtocolReadWriter) ServerHandshake(welcome *ProtocolMessage) error {
+	if welcome == nil || !welcome.IsValidWelcome() {
+		return fmt.Errorf("ServerHandshake requires a valid WELCOME message")
+	}
+	version, err := NegotiateVersion(welcome.Major, welcome.Minor)
+	if err != nil {
+		return err
+	}
+	if err := c.Write(welcome); err != nil {
+		return err
+	}
+	c.negotiation.Lock()
+	defer c.negotiation.Unlock()
+	c.negotiation.version = version
+	c.negotiation.done = true
+	return nil
+}
+
+// ClientHandshake begins a connection from the client side by reading the
+// server's WELCOME message and negotiating a protocol version with
+// NegotiateVersion. It returns the WELCOME so that the client can learn the
+// server's root and recent messages. If the server's version is incompatible,
+// the error is a *VersionError and the caller should close the connection.
+func (c *ProtocolReadWriter) ClientHandshake() (*ProtocolMessage, error) {
+	welcome := new(ProtocolMessage)
+	if err := c.Read(welcome); err != nil {
+		return nil, err
+	}
+	if welcome.Type != WelcomeType {
+		return nil, fmt.Errorf("Expected WELCOME to begin connection, got %s", typeName(welcome.Type))
+	}
+	version, err := NegotiateVersion(welcome.Major, welcome.Minor)
+	if err != nil {
+		return nil, err
+	}
+	c.negotiation.Lock()
+	defer c.negotiation.Unlock()
+	c.negotiation.version = version
+	c.negotiation.done = true
+	return welcome, nil
+}
+
+// Version returns the protocol version negotiated by ServerHandshake or
+// ClientHandshake. The boolean result is false if no handshake has completed.
+func (c *ProtocolReadWriter) Version() (Version, bool) {
+	c.negotiation.Lock()
+	defer c.negotiation.Unlock()
+	return c.negotiation.version, c.negotiation.done
+}
@@ -0,0 +1,100 @@
+package arbor_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	arbor "github.com/arborchat/arbor-go"
+	"github.com/onsi/gomega"
+)
+
+// TestNegotiateVersion ensures that peers with compatible versions agree on the older
+// version and incompatible peers are rejected.
+func TestNegotiateVersion(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	version, err := arbor.NegotiateVersion(arbor.ProtocolMajor, arbor.ProtocolMinor)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(version).To(gomega.Equal(arbor.Version{Major: arbor.ProtocolMajor, Minor: arbor.ProtocolMinor}))
+
+	version, err = arbor.NegotiateVersion(arbor.ProtocolMajor, arbor.ProtocolMinor+1)
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(version.Minor).To(gomega.Equal(uint8(arbor.ProtocolMinor)))
+
+	for _, peer := range []arbor.Version{
+		{Major: arbor.ProtocolMajor + 1, Minor: arbor.ProtocolMinor},
+		{Major: arbor.ProtocolMajor, Minor: arbor.MinSupportedMinor - 1},
+	} {
+		_, err = arbor.NegotiateVersion(peer.Major, peer.Minor)
+		var versionErr *arbor.VersionError
+		g.Expect(errors.As(err, &versionErr)).To(gomega.BeTrue())
+		g.Expect(versionErr.Peer).To(gomega.Equal(peer))
+	}
+}
+
+// connectedPair returns two ProtocolReadWriters connected to each other.
+func connectedPair(t *testing.T, opts ...arbor.Option) (*arbor.ProtocolReadWriter, *arbor.ProtocolReadWriter) {
+	serverConn, clientConn := net.Pipe()
+	server, err := arbor.NewProtocolReadWriter(serverConn, opts...)
+	if err != nil {
+		t.Fatal("Unable to create server", err)
+	}
+	client, err := arbor.NewProtocolReadWriter(clientConn, opts...)
+	if err != nil {
+		t.Fatal("Unable to create client", err)
+	}
+	return server, client
+}
+
+// TestHandshake ensures that a client and server can agree on a version by exchanging
+// a WELCOME message.
+func TestHandshake(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server, client := connectedPair(t)
+	defer server.Close()
+	defer client.Close()
+	_, negotiated := client.Version()
+	g.Expect(negotiated).To(gomega.BeFalse())
+
+	welcome := getWelcome()
+	welcome.Minor = arbor.ProtocolMinor + 1
+	go func() {
+		if err := server.ServerHandshake(welcome); err != nil {
+			t.Error("Server handshake failed", err)
+		}
+	}()
+	received, err := client.ClientHandshake()
+	g.Expect(err).ToNot(gomega.HaveOccurred())
+	g.Expect(received.Equals(welcome)).To(gomega.BeTrue())
+	version, negotiated := client.Version()
+	g.Expect(negotiated).To(gomega.BeTrue())
+	g.Expect(version).To(gomega.Equal(arbor.Version{Major: arbor.ProtocolMajor, Minor: arbor.ProtocolMinor}))
+	g.Eventually(func() bool {
+		_, done := server.Version()
+		return done
+	}).Should(gomega.BeTrue())
+	version, _ = server.Version()
+	g.Expect(version).To(gomega.Equal(arbor.Version{Major: arbor.ProtocolMajor, Minor: arbor.ProtocolMinor}))
+}
+
+// TestHandshakeIncompatible ensures that clients reject servers with an incompatible
+// major version, and that servers refuse to advertise one.
+func TestHandshakeIncompatible(t *testing.T) {
+	g := gomega.NewGomegaWithT(t)
+	server, client := connectedPair(t)
+	defer server.Close()
+	defer client.Close()
+	welcome := getWelcome()
+	welcome.Major = arbor.ProtocolMajor + 1
+	var versionErr *arbor.VersionError
+	g.Expect(errors.As(server.ServerHandshake(welcome), &versionErr)).To(gomega.BeTrue())
+	_, negotiated := server.Version()
+	g.Expect(negotiated).To(gomega.BeFalse())
+
+	go func() { _ = server.Write(welcome) }()
+	_, err := client.ClientHandshake()
+	g.Expect(errors.As(err, &versionErr)).To(gomega.BeTrue())
+	_, negotiated = client.Version()
+	g.Expect(negotiated).To(gomega.BeFalse())
+	g.Expect(server.ServerHandshake(getNew())).ToNot(gomega.Succeed())
+}